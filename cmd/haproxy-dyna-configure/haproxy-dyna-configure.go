@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"os"
 
 	"github.com/rvanderp3/haproxy-dyna-configure/pkg"
@@ -9,22 +10,65 @@ import (
 )
 
 func main() {
+	unknownSNIResponder := flag.Bool("unknown-sni-responder", false, "serve the unknown SNI responder instead of configuring haproxy")
+	dryRun := flag.Bool("dry-run", false, "print a unified diff of the pending changes instead of applying them, exit 1 if there are any")
+	flag.StringVar(&pkg.MonitorConfigurationFile, "config", pkg.MonitorConfigurationFile, "path of monitor-config.yaml")
+	flag.StringVar(&pkg.Overrides.ConfigurationFile, "haproxy-config", "", "haproxy configuration file, overrides client.configuration-file")
+	flag.StringVar(&pkg.Overrides.Haproxy, "haproxy-bin", "", "haproxy binary, overrides client.haproxy")
+	flag.StringVar(&pkg.Overrides.TransactionDir, "transaction-dir", "", "client-native transaction directory, overrides client.transaction-dir")
+	flag.StringVar(&pkg.Overrides.StatsSocket, "stats-socket", "", "haproxy stats socket, overrides stats-socket")
+	flag.StringVar(&pkg.Overrides.MasterSocket, "master-socket", "", "haproxy master CLI socket, overrides reload.master-socket")
+	flag.Parse()
+
 	ctx := context.TODO()
 	log.SetOutput(os.Stdout)
+	if *dryRun {
+		// keep stdout for the diff
+		log.SetOutput(os.Stderr)
+	}
 	log.SetLevel(log.DebugLevel)
 	err := pkg.Initialize(ctx)
 	if err != nil {
 		log.Errorf("unable to initialize %s", err)
+		if *dryRun {
+			os.Exit(2)
+		}
+		return
+	}
+	if *unknownSNIResponder {
+		err = pkg.ServeUnknownSNI(ctx)
+		if err != nil {
+			log.Errorf("unable to serve unknown SNI responder %s", err)
+		}
 		return
 	}
 	cfg, err := pkg.CheckRanges(ctx)
 	if err != nil {
 		log.Errorf("unable to check ranges %s", err)
+		if *dryRun {
+			os.Exit(2)
+		}
 		return
 	}
-	err = pkg.ApplyConfiguration(cfg)
+	if *dryRun {
+		pending, err := pkg.DryRun(cfg, os.Stdout)
+		if err != nil {
+			log.Errorf("unable to plan configuration %s", err)
+			os.Exit(2)
+		}
+		if pending {
+			os.Exit(1)
+		}
+		return
+	}
+	changed, err := pkg.ApplyConfiguration(cfg)
 	if err != nil {
 		log.Errorf("unable to apply configuration %s", err)
 		return
 	}
+	if changed {
+		log.Info("haproxy configuration changed, reload required")
+	} else {
+		log.Info("haproxy is up to date, no reload required")
+	}
 }
@@ -1,27 +1,239 @@
 package data
 
 type MonitorPort struct {
-	Port       int64  `yaml:"port"`
-	Name       string `yaml:"name"`
-	Targets    []string
-	PathPrefix string `yaml:"path-prefix"`
-	PathMatch  string `yaml:"path-match"`
-	Protocol   string `yaml:"protocol"`
+	Port          int64  `yaml:"port"`
+	Name          string `yaml:"name"`
+	Targets       []string
+	TargetDomains map[string]string `yaml:"-"`
+	PathPrefix    string            `yaml:"path-prefix"`
+	PathMatch     string            `yaml:"path-match"`
+	Protocol      string            `yaml:"protocol"`
+	Probe         string            `yaml:"probe"`
+	ListenPort    int64             `yaml:"listen-port"`
+	BindAddresses []string          `yaml:"bind-addresses"`
+	BindOptions   BindOptions       `yaml:"bind-options"`
+	HealthCheck   HealthCheck       `yaml:"health-check"`
+	Balance       string            `yaml:"balance"`
+	Persistence   Persistence       `yaml:"persistence"`
+	Weight        int64             `yaml:"weight"`
+	Weights       map[string]int64  `yaml:"weights"`
+	SendProxy     string            `yaml:"send-proxy"`
+	Mode          string            `yaml:"mode"`
+	DomainFrom    int64             `yaml:"domain-from"`
+}
+
+// Persistence keeps clients on the server they were first sent to through a
+// stick table. Size is in entries and Expire in milliseconds.
+type Persistence struct {
+	Type   string `yaml:"type"`
+	Size   int64  `yaml:"size"`
+	Expire int64  `yaml:"expire"`
+}
+
+// HealthCheck configures how HAProxy checks the servers of the backends
+// generated for a monitor port. Timers are in milliseconds.
+type HealthCheck struct {
+	Type  string `yaml:"type"`
+	Path  string `yaml:"path"`
+	SNI   string `yaml:"sni"`
+	Inter int64  `yaml:"inter"`
+	Fall  int64  `yaml:"fall"`
+	Rise  int64  `yaml:"rise"`
+	Port  int64  `yaml:"port"`
+}
+
+// BindOptions are added to every bind of the frontend a monitor port is
+// served on.
+type BindOptions struct {
+	Transparent    bool   `yaml:"transparent"`
+	Process        string `yaml:"process"`
+	TCPUserTimeout int64  `yaml:"tcp-user-timeout"`
+	AcceptProxy    bool   `yaml:"accept-proxy"`
 }
 
 type MonitorRange struct {
+	Name           string        `yaml:"name"`
 	IpAddressStart string        `yaml:"ip-address-start"`
 	IpAddressEnd   string        `yaml:"ip-address-end"`
+	Cidr           string        `yaml:"cidr"`
+	Ranges         []string      `yaml:"ranges"`
+	Exclude        []string      `yaml:"exclude"`
+	SparseHosts    int           `yaml:"sparse-hosts"`
 	MonitorPorts   []MonitorPort `yaml:"monitor-ports"`
-	BaseDomain     string
+	MaxConcurrency int           `yaml:"max-concurrency"`
 }
 
 type MonitorConfig struct {
-	MonitorRanges []MonitorRange `yaml:"monitor-ranges"`
-	CheckTimeout  int            `yaml:"check-timeout"`
-	SubnetsJson   string         `yaml:"subnets-json-path"`
+	MonitorRanges  []MonitorRange   `yaml:"monitor-ranges"`
+	CheckTimeout   int              `yaml:"check-timeout"`
+	ScanTimeout    int              `yaml:"scan-timeout"`
+	MaxConcurrency int              `yaml:"max-concurrency"`
+	IpFamily       string           `yaml:"ip-family"`
+	ServerSlots    int              `yaml:"server-slots"`
+	StatsSocket    string           `yaml:"stats-socket"`
+	MapDir         string           `yaml:"map-dir"`
+	Reload         ReloadConfig     `yaml:"reload"`
+	UnknownSNI     UnknownSNIConfig `yaml:"unknown-sni"`
+	Ownership      OwnershipConfig  `yaml:"ownership"`
+	Client         ClientConfig     `yaml:"client"`
+	Output         OutputConfig     `yaml:"output"`
+	Targets        []OutputTarget   `yaml:"targets"`
+	Haproxy        *HaproxyConfig   `yaml:"haproxy"`
+	SubnetsJson    string           `yaml:"subnets-json-path"`
+}
+
+// UnknownSNIConfig decides what happens to connections whose SNI does not
+// match any discovered cluster.
+type UnknownSNIConfig struct {
+	Policy           string `yaml:"policy"`
+	Backend          string `yaml:"backend"`
+	ResponderAddress string `yaml:"responder-address"`
+}
+
+// ReloadConfig controls how HAProxy is validated and reloaded after the
+// configuration file changed. An empty Method leaves the reload to the
+// operator.
+type ReloadConfig struct {
+	Method       string `yaml:"method"`
+	MasterSocket string `yaml:"master-socket"`
+	PidFile      string `yaml:"pid-file"`
+	Command      string `yaml:"command"`
+	Validate     bool   `yaml:"validate"`
+	Haproxy      string `yaml:"haproxy"`
+	Timeout      int    `yaml:"timeout"`
+}
+
+// OwnershipConfig identifies the frontends and backends dyna-configure
+// manages. With a prefix, every generated name starts with it and only
+// sections named with it are touched. Otherwise managed sections are
+// recognized by the marker comment on their mode line.
+type OwnershipConfig struct {
+	Prefix string `yaml:"prefix"`
+	Marker string `yaml:"marker"`
+}
+
+// ClientConfig sets the client-native parameters used to read and write the
+// HAProxy configuration. Empty fields keep the defaults.
+type ClientConfig struct {
+	ConfigurationFile      string `yaml:"configuration-file"`
+	Haproxy                string `yaml:"haproxy"`
+	UseValidation          *bool  `yaml:"use-validation"`
+	PersistentTransactions bool   `yaml:"persistent-transactions"`
+	TransactionDir         string `yaml:"transaction-dir"`
+	BackupsNumber          int    `yaml:"backups-number"`
+	MasterWorker           bool   `yaml:"master-worker"`
+}
+
+// OutputConfig selects how the desired configuration is written. The
+// client-native output edits haproxy.cfg in place, the template output
+// renders a managed include file from a text/template and the dataplane
+// output pushes it to the Data Plane API at URL.
+type OutputConfig struct {
+	Type     string `yaml:"type"`
+	File     string `yaml:"file"`
+	Template string `yaml:"template"`
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// OutputTarget is one HAProxy fed from the shared discovery pass. Its output,
+// client and reload blocks replace the top-level ones when set, as do its
+// stats-socket and map-dir.
+type OutputTarget struct {
+	Name         string        `yaml:"name"`
+	Output       OutputConfig  `yaml:"output"`
+	Client       ClientConfig  `yaml:"client"`
+	Reload       ReloadConfig  `yaml:"reload"`
+	StatsSocket  string        `yaml:"stats-socket"`
+	MapDir       string        `yaml:"map-dir"`
+	Filter       TargetFilter  `yaml:"filter"`
+	PortMappings []PortMapping `yaml:"port-mappings"`
+}
+
+// TargetFilter selects the clusters an output target sees. Domains are
+// regular expressions matched against the base domain, Ranges name monitor
+// ranges the targets must have been found in and Ports lists the monitor
+// ports to serve. Empty lists match everything.
+type TargetFilter struct {
+	Domains []string `yaml:"domains"`
+	Ranges  []string `yaml:"ranges"`
+	Ports   []int64  `yaml:"ports"`
+}
+
+// PortMapping serves the monitor port Port on ListenPort for one output
+// target.
+type PortMapping struct {
+	Port       int64 `yaml:"port"`
+	ListenPort int64 `yaml:"listen-port"`
+}
+
+// HaproxyConfig manages the global and defaults sections of haproxy.cfg and
+// a stats frontend, so a blank host can be set up without editing the file by
+// hand. Directives that are not set are left as they are.
+type HaproxyConfig struct {
+	Global   GlobalConfig   `yaml:"global"`
+	Defaults DefaultsConfig `yaml:"defaults"`
+	Stats    StatsConfig    `yaml:"stats"`
+}
+
+// GlobalConfig sets directives of the global section. StatsTimeout is an
+// HAProxy time such as 30s.
+type GlobalConfig struct {
+	Maxconn      int64             `yaml:"maxconn"`
+	Nbthread     int64             `yaml:"nbthread"`
+	StatsSocket  StatsSocketConfig `yaml:"stats-socket"`
+	StatsTimeout string            `yaml:"stats-timeout"`
+	Logs         []LogTarget       `yaml:"logs"`
+}
+
+// StatsSocketConfig writes the stats socket line for the stats-socket path
+// the runtime API is used on. ExposeFdListeners defaults to true, as seamless
+// reloads hand the listening sockets over through it.
+type StatsSocketConfig struct {
+	Enabled           bool   `yaml:"enabled"`
+	Mode              string `yaml:"mode"`
+	Level             string `yaml:"level"`
+	ExposeFdListeners *bool  `yaml:"expose-fd-listeners"`
+}
+
+// DefaultsConfig sets directives of the defaults section. Timeouts maps a
+// timeout name such as connect or client to an HAProxy time.
+type DefaultsConfig struct {
+	Mode      string            `yaml:"mode"`
+	Maxconn   int64             `yaml:"maxconn"`
+	Retries   int64             `yaml:"retries"`
+	Timeouts  map[string]string `yaml:"timeouts"`
+	Logs      []LogTarget       `yaml:"logs"`
+	LogFormat string            `yaml:"log-format"`
+}
+
+// LogTarget is a log line. In the defaults section the address global
+// stands for log global.
+type LogTarget struct {
+	Address  string `yaml:"address"`
+	Facility string `yaml:"facility"`
+	Level    string `yaml:"level"`
+	MinLevel string `yaml:"min-level"`
+	Format   string `yaml:"format"`
+	Length   int64  `yaml:"length"`
+}
+
+// StatsConfig serves the HAProxy stats page on Bind, an address:port. An
+// empty Bind leaves the stats frontend out.
+type StatsConfig struct {
+	Bind    string `yaml:"bind"`
+	URI     string `yaml:"uri"`
+	Refresh string `yaml:"refresh"`
 }
 
 type MonitorConfigSpec struct {
 	MonitorConfig MonitorConfig `yaml:"monitor-config"`
 }
+
+// Cluster holds the targets discovered for a single base domain. Each port
+// carries its monitor settings and only the targets belonging to the cluster.
+type Cluster struct {
+	BaseDomain string
+	Ports      []MonitorPort
+}
@@ -6,6 +6,7 @@ require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-yaml/yaml v2.1.0+incompatible
 	github.com/haproxytech/client-native v1.2.7
+	github.com/haproxytech/config-parser v1.2.0
 	github.com/haproxytech/models v1.2.5-0.20191122125615-30d0235b81ec
 	github.com/netdata/go.d.plugin v0.52.0
 	github.com/openshift/api v0.0.0-20230609104832-ca79cab44f4a
@@ -32,7 +33,6 @@ require (
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/google/gofuzz v1.2.0 // indirect
 	github.com/google/uuid v1.3.0 // indirect
-	github.com/haproxytech/config-parser v1.2.0 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
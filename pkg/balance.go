@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"net/netip"
+
+	"github.com/haproxytech/models"
+	"github.com/pkg/errors"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+const (
+	// PersistenceSource sticks each client IP address to a server.
+	PersistenceSource = "source"
+
+	DefaultStickTableSize   = 100000
+	DefaultStickTableExpire = 30 * 60 * 1000
+
+	maxServerWeight = 256
+)
+
+var balanceAlgorithms = map[string]bool{
+	models.BalanceAlgorithmRoundrobin: true,
+	models.BalanceAlgorithmStaticRr:   true,
+	models.BalanceAlgorithmLeastconn:  true,
+	models.BalanceAlgorithmFirst:      true,
+	models.BalanceAlgorithmSource:     true,
+	models.BalanceAlgorithmRandom:     true,
+}
+
+// validateBalance checks the balance options of port. Weights keys are
+// rewritten in place to the canonical form of their address, the form probed
+// targets are written in, so "fd00:0::2" weighs fd00::2.
+func validateBalance(port *data.MonitorPort) error {
+	if len(port.Balance) > 0 && !balanceAlgorithms[port.Balance] {
+		return errors.Errorf("unknown balance %s for port %s", port.Balance, port.Name)
+	}
+	switch port.Persistence.Type {
+	case "", PersistenceSource:
+	default:
+		return errors.Errorf("unknown persistence type %s for port %s", port.Persistence.Type, port.Name)
+	}
+	if port.Weight < 0 || port.Weight > maxServerWeight {
+		return errors.Errorf("weight %d for port %s is out of range", port.Weight, port.Name)
+	}
+	canonical := map[string]int64{}
+	for target, weight := range port.Weights {
+		addr, err := netip.ParseAddr(target)
+		if err != nil {
+			return errors.Wrapf(err, "invalid weights entry for port %s", port.Name)
+		}
+		if weight < 0 || weight > maxServerWeight {
+			return errors.Errorf("weight %d of %s for port %s is out of range", weight, target, port.Name)
+		}
+		if _, ok := canonical[addr.String()]; ok {
+			return errors.Errorf("duplicate weights entry %s for port %s", addr, port.Name)
+		}
+		canonical[addr.String()] = weight
+	}
+	for target := range port.Weights {
+		delete(port.Weights, target)
+	}
+	for target, weight := range canonical {
+		port.Weights[target] = weight
+	}
+	return nil
+}
+
+// serverWeight returns the weight of target: its weights entry, the port
+// weight, or nil to leave HAProxy's default.
+func serverWeight(port *data.MonitorPort, target string) *int64 {
+	if weight, ok := port.Weights[target]; ok {
+		return &weight
+	}
+	return optionalInt64(port.Weight)
+}
+
+// applyBalance sets the balance algorithm of backend and, with source
+// persistence, the stick table and rule that pin clients to a server.
+func applyBalance(backend *backendModel, port *data.MonitorPort, ipFamily string) {
+	if len(port.Balance) > 0 {
+		// config-parser reads a balance line without arguments back as
+		// an empty list.
+		backend.Backend.Balance = &models.Balance{
+			Algorithm: port.Balance,
+			Arguments: []string{},
+		}
+	}
+	if port.Persistence.Type != PersistenceSource {
+		return
+	}
+
+	tableType := "ip"
+	if ipFamily == IpFamilyIPv6 || ipFamily == IpFamilyDual {
+		tableType = "ipv6"
+	}
+	size := port.Persistence.Size
+	if size <= 0 {
+		size = DefaultStickTableSize
+	}
+	expire := port.Persistence.Expire
+	if expire <= 0 {
+		expire = DefaultStickTableExpire
+	}
+	id := int64(0)
+	backend.Backend.StickTable = &models.BackendStickTable{
+		Type:   tableType,
+		Size:   &size,
+		Expire: &expire,
+	}
+	backend.StickRules = models.StickRules{
+		{
+			ID:      &id,
+			Type:    models.StickRuleTypeOn,
+			Pattern: "src",
+		},
+	}
+}
@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func TestReconcileBalanceAndPersistence(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+
+	clusters := testClusters()
+	clusters[0].Ports[0].Balance = "leastconn"
+	clusters[0].Ports[0].Persistence = data.Persistence{Type: PersistenceSource, Expire: 60000}
+	clusters[0].Ports[0].Weights = map[string]int64{"192.168.88.2": 50}
+	clusters[0].Ports[1].Weight = 10
+	_, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"balance leastconn",
+		"stick-table type ip size 100000 expire 60000",
+		"stick on src",
+		"server slot1 192.168.88.2:6443 check weight 50 verify none",
+		"server slot1 192.168.88.3:443 check weight 10 verify none",
+		"server slot2 127.0.0.1:443 disabled check weight 10 verify none",
+	} {
+		if !strings.Contains(string(raw), expected) {
+			t.Errorf("expected %q in configuration:\n%s", expected, raw)
+		}
+	}
+
+	result, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) != 0 {
+		t.Errorf("expected no changes, got %v", result.Changes)
+	}
+
+	clusters[0].Ports[0].Weights["192.168.88.2"] = 20
+	result, err = reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if result.ReloadRequired {
+		t.Errorf("changing a weight should not require a reload, got %v", result.Changes)
+	}
+	if len(result.ServerUpdates) != 1 || result.ServerUpdates[0].Weight == nil || *result.ServerUpdates[0].Weight != 20 {
+		t.Errorf("expected a weight update, got %+v", result.ServerUpdates)
+	}
+}
+
+func TestValidateBalance(t *testing.T) {
+	valid := []data.MonitorPort{
+		{},
+		{Balance: "roundrobin", Persistence: data.Persistence{Type: PersistenceSource}},
+		{Weight: 100, Weights: map[string]int64{"fd00::2": 0}},
+	}
+	for _, port := range valid {
+		if err := validateBalance(&port); err != nil {
+			t.Errorf("%+v: %s", port, err)
+		}
+	}
+	invalid := []data.MonitorPort{
+		{Balance: "fastest"},
+		{Persistence: data.Persistence{Type: "cookie"}},
+		{Weight: 257},
+		{Weights: map[string]int64{"api": 1}},
+		{Weights: map[string]int64{"fd00::2": 1, "fd00:0::2": 2}},
+	}
+	for _, port := range invalid {
+		if err := validateBalance(&port); err == nil {
+			t.Errorf("%+v: expected an error", port)
+		}
+	}
+}
+
+func TestValidateBalanceCanonicalizesWeights(t *testing.T) {
+	port := data.MonitorPort{Weights: map[string]int64{"FD00:0:0::2": 10, "192.168.88.2": 20}}
+	if err := validateBalance(&port); err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	expected := map[string]int64{"fd00::2": 10, "192.168.88.2": 20}
+	if !reflect.DeepEqual(port.Weights, expected) {
+		t.Errorf("expected weights %v, got %v", expected, port.Weights)
+	}
+	if weight := serverWeight(&port, "fd00::2"); weight == nil || *weight != 10 {
+		t.Errorf("expected the weight of fd00::2 to be 10, got %v", weight)
+	}
+}
@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"github.com/haproxytech/client-native/configuration"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+const (
+	// DefaultTransactionDir is where client-native keeps transaction files
+	// unless transaction-dir is set.
+	DefaultTransactionDir = "/etc/haproxy/tx"
+)
+
+// PathOverrides are set from command line flags and take precedence over
+// monitor-config.yaml, so several HAProxy instances can share one config.
+type PathOverrides struct {
+	ConfigurationFile string
+	Haproxy           string
+	TransactionDir    string
+	StatsSocket       string
+	MasterSocket      string
+}
+
+// Overrides holds the paths given on the command line.
+var Overrides PathOverrides
+
+func (o *PathOverrides) apply(monitorConfig *data.MonitorConfig) {
+	if len(o.ConfigurationFile) > 0 {
+		monitorConfig.Client.ConfigurationFile = o.ConfigurationFile
+	}
+	if len(o.Haproxy) > 0 {
+		monitorConfig.Client.Haproxy = o.Haproxy
+	}
+	if len(o.TransactionDir) > 0 {
+		monitorConfig.Client.TransactionDir = o.TransactionDir
+	}
+	if len(o.StatsSocket) > 0 {
+		monitorConfig.StatsSocket = o.StatsSocket
+	}
+	if len(o.MasterSocket) > 0 {
+		monitorConfig.Reload.MasterSocket = o.MasterSocket
+	}
+}
+
+// clientParams returns the client-native parameters for client, filling in
+// the defaults for every field left empty.
+func clientParams(client *data.ClientConfig) configuration.ClientParams {
+	params := configuration.ClientParams{
+		ConfigurationFile:      client.ConfigurationFile,
+		Haproxy:                client.Haproxy,
+		UseValidation:          configuration.DefaultUseValidation,
+		PersistentTransactions: client.PersistentTransactions,
+		TransactionDir:         client.TransactionDir,
+		BackupsNumber:          client.BackupsNumber,
+		MasterWorker:           client.MasterWorker,
+	}
+	if len(params.ConfigurationFile) == 0 {
+		params.ConfigurationFile = configuration.DefaultConfigurationFile
+	}
+	if len(params.Haproxy) == 0 {
+		params.Haproxy = configuration.DefaultHaproxy
+	}
+	if client.UseValidation != nil {
+		params.UseValidation = *client.UseValidation
+	}
+	if len(params.TransactionDir) == 0 {
+		params.TransactionDir = DefaultTransactionDir
+	}
+	return params
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/haproxytech/client-native/configuration"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func TestClientParams(t *testing.T) {
+	params := clientParams(&data.ClientConfig{})
+	if params.ConfigurationFile != configuration.DefaultConfigurationFile || params.Haproxy != configuration.DefaultHaproxy ||
+		params.TransactionDir != DefaultTransactionDir || params.UseValidation != configuration.DefaultUseValidation {
+		t.Errorf("unexpected defaults %+v", params)
+	}
+
+	useValidation := false
+	params = clientParams(&data.ClientConfig{
+		ConfigurationFile: "/srv/haproxy-test/haproxy.cfg",
+		UseValidation:     &useValidation,
+		BackupsNumber:     3,
+	})
+	if params.ConfigurationFile != "/srv/haproxy-test/haproxy.cfg" || params.UseValidation || params.BackupsNumber != 3 {
+		t.Errorf("expected configured params, got %+v", params)
+	}
+}
+
+func TestPathOverrides(t *testing.T) {
+	monitorConfig := &data.MonitorConfig{
+		StatsSocket: "/var/run/haproxy.sock",
+		Client:      data.ClientConfig{ConfigurationFile: "/etc/haproxy/haproxy.cfg", TransactionDir: "/etc/haproxy/tx"},
+		Reload:      data.ReloadConfig{MasterSocket: "/var/run/haproxy-master.sock"},
+	}
+	overrides := PathOverrides{
+		ConfigurationFile: "/srv/haproxy-test/haproxy.cfg",
+		StatsSocket:       "/srv/haproxy-test/stats.sock",
+	}
+	overrides.apply(monitorConfig)
+	if monitorConfig.Client.ConfigurationFile != "/srv/haproxy-test/haproxy.cfg" || monitorConfig.StatsSocket != "/srv/haproxy-test/stats.sock" {
+		t.Errorf("expected flags to win, got %+v", monitorConfig)
+	}
+	if monitorConfig.Client.TransactionDir != "/etc/haproxy/tx" || monitorConfig.Reload.MasterSocket != "/var/run/haproxy-master.sock" {
+		t.Errorf("expected unset flags to keep the configured paths, got %+v", monitorConfig)
+	}
+}
+
+func TestReconcilePersistentTransactions(t *testing.T) {
+	client, configFile := newTestClient(t)
+	params := client.ClientParams
+	params.PersistentTransactions = true
+	if err := client.Init(params); err != nil {
+		t.Fatal(err)
+	}
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+
+	clusters := testClusters()
+	clusters[0].Ports[0].HealthCheck = data.HealthCheck{Type: HealthCheckHTTPS}
+	_, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"mode tcp # " + DefaultOwnershipMarker,
+		"server slot1 192.168.88.2:6443 check verify none check-ssl check-sni api.a.example.com",
+	} {
+		if !strings.Contains(string(raw), expected) {
+			t.Errorf("expected %q in configuration:\n%s", expected, raw)
+		}
+	}
+
+	clusters[0].Ports[0].HealthCheck.SNI = "healthz.a.example.com"
+	_, err = reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err = os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), "check-sni healthz.a.example.com") {
+		t.Errorf("expected options changed only on the parser to be committed:\n%s", raw)
+	}
+}
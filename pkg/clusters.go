@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"sort"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+	"github.com/sirupsen/logrus"
+)
+
+// groupClusters groups the targets discovered in monitorRange by the base
+// domain each target presented, so that clusters sharing a range are kept
+// apart. Targets that did not present a base domain are dropped.
+func groupClusters(monitorRange *data.MonitorRange) []data.Cluster {
+	clusters := map[string]*data.Cluster{}
+	for _, monitorPort := range monitorRange.MonitorPorts {
+		byDomain := map[string][]string{}
+		for _, target := range monitorPort.Targets {
+			domain := targetDomain(monitorRange, &monitorPort, target)
+			if len(domain) == 0 {
+				logrus.Debugf("no base domain found for %s port %d", target, monitorPort.Port)
+				continue
+			}
+			byDomain[domain] = append(byDomain[domain], target)
+		}
+		for domain, targets := range byDomain {
+			cluster, ok := clusters[domain]
+			if !ok {
+				cluster = &data.Cluster{BaseDomain: domain}
+				clusters[domain] = cluster
+			}
+			clusterPort := monitorPort
+			clusterPort.Targets = targets
+			clusterPort.TargetDomains = nil
+			sort.Strings(clusterPort.Targets)
+			cluster.Ports = append(cluster.Ports, clusterPort)
+		}
+	}
+
+	result := []data.Cluster{}
+	for _, cluster := range clusters {
+		result = append(result, *cluster)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].BaseDomain < result[j].BaseDomain
+	})
+	return result
+}
+
+// mergeClusters merges clusters with the same base domain, such as a cluster
+// whose API VIP and workers sit in different ranges, so that each domain and
+// port ends up with a single de-duplicated list of targets. The settings of
+// the first range to define a port win.
+func mergeClusters(clusters []data.Cluster) []data.Cluster {
+	merged := map[string]*data.Cluster{}
+	for _, cluster := range clusters {
+		into, ok := merged[cluster.BaseDomain]
+		if !ok {
+			into = &data.Cluster{BaseDomain: cluster.BaseDomain}
+			merged[cluster.BaseDomain] = into
+		}
+		for _, monitorPort := range cluster.Ports {
+			idx := clusterPortIndex(into, monitorPort.Port)
+			if idx == -1 {
+				monitorPort.Targets = append([]string{}, monitorPort.Targets...)
+				into.Ports = append(into.Ports, monitorPort)
+				continue
+			}
+			into.Ports[idx].Targets = append(into.Ports[idx].Targets, monitorPort.Targets...)
+		}
+	}
+
+	result := []data.Cluster{}
+	for _, cluster := range merged {
+		for idx := range cluster.Ports {
+			cluster.Ports[idx].Targets = uniqueSorted(cluster.Ports[idx].Targets)
+		}
+		result = append(result, *cluster)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].BaseDomain < result[j].BaseDomain
+	})
+	return result
+}
+
+func clusterPortIndex(cluster *data.Cluster, port int64) int {
+	for idx := range cluster.Ports {
+		if cluster.Ports[idx].Port == port {
+			return idx
+		}
+	}
+	return -1
+}
+
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	result := []string{}
+	for idx, value := range values {
+		if idx > 0 && values[idx-1] == value {
+			continue
+		}
+		result = append(result, value)
+	}
+	return result
+}
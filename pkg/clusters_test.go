@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func TestGroupClusters(t *testing.T) {
+	monitorRange := data.MonitorRange{
+		MonitorPorts: []data.MonitorPort{
+			{
+				Port:    6443,
+				Targets: []string{"192.168.88.3", "192.168.88.2", "192.168.88.9"},
+				TargetDomains: map[string]string{
+					"192.168.88.2": "b.example.com",
+					"192.168.88.3": "a.example.com",
+				},
+			},
+			{
+				Port:    443,
+				Targets: []string{"192.168.88.4", "192.168.88.5"},
+				TargetDomains: map[string]string{
+					"192.168.88.4": "a.example.com",
+					"192.168.88.5": "a.example.com",
+				},
+			},
+		},
+	}
+
+	clusters := groupClusters(&monitorRange)
+	expected := []data.Cluster{
+		{
+			BaseDomain: "a.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 6443, Targets: []string{"192.168.88.3"}},
+				{Port: 443, Targets: []string{"192.168.88.4", "192.168.88.5"}},
+			},
+		},
+		{
+			BaseDomain: "b.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 6443, Targets: []string{"192.168.88.2"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(clusters, expected) {
+		t.Errorf("expected %+v, got %+v", expected, clusters)
+	}
+}
+
+func TestMergeClusters(t *testing.T) {
+	clusters := []data.Cluster{
+		{
+			BaseDomain: "a.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 6443, Targets: []string{"192.168.88.3"}},
+			},
+		},
+		{
+			BaseDomain: "b.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 443, Targets: []string{"192.168.90.2"}},
+			},
+		},
+		{
+			BaseDomain: "a.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 6443, Targets: []string{"192.168.89.2", "192.168.88.3"}},
+				{Port: 443, Targets: []string{"192.168.89.4"}},
+			},
+		},
+	}
+
+	merged := mergeClusters(clusters)
+	expected := []data.Cluster{
+		{
+			BaseDomain: "a.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 6443, Targets: []string{"192.168.88.3", "192.168.89.2"}},
+				{Port: 443, Targets: []string{"192.168.89.4"}},
+			},
+		},
+		{
+			BaseDomain: "b.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 443, Targets: []string{"192.168.90.2"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected %+v, got %+v", expected, merged)
+	}
+}
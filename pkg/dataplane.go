@@ -0,0 +1,940 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	parser "github.com/haproxytech/config-parser"
+	"github.com/haproxytech/models"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// dataplaneVersionHeader carries the configuration version on Data
+	// Plane API responses.
+	dataplaneVersionHeader = "Configuration-Version"
+
+	dataplaneConfigurationPath = "/services/haproxy/configuration/"
+	dataplaneTransactionsPath  = "/services/haproxy/transactions"
+	dataplaneMapsPath          = "/services/haproxy/runtime/maps"
+	dataplaneMapEntriesPath    = "/services/haproxy/runtime/maps_entries"
+
+	dataplaneTimeout = 30 * time.Second
+)
+
+// dataplaneError is an error answer of the Data Plane API.
+type dataplaneError struct {
+	Status  int
+	Message string
+}
+
+func (e *dataplaneError) Error() string {
+	return fmt.Sprintf("data plane API answered %d: %s", e.Status, e.Message)
+}
+
+func dataplaneStatus(err error) int {
+	var apiErr *dataplaneError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status
+	}
+	return 0
+}
+
+// dataplaneClient talks to the Data Plane API at url, which includes the API
+// version, e.g. http://haproxy-a:5555/v2.
+type dataplaneClient struct {
+	url      string
+	username string
+	password string
+	http     *http.Client
+}
+
+func newDataplaneClient(config *data.OutputConfig) *dataplaneClient {
+	return &dataplaneClient{
+		url:      strings.TrimSuffix(config.URL, "/"),
+		username: config.Username,
+		password: config.Password,
+		http:     &http.Client{Timeout: dataplaneTimeout},
+	}
+}
+
+// do sends body, if any, as JSON and decodes the answer into out, if any.
+func (c *dataplaneClient) do(method string, path string, query url.Values, body interface{}, out interface{}) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	return c.send(method, path, query, "application/json", reader, out)
+}
+
+func (c *dataplaneClient) send(method string, path string, query url.Values, contentType string, body io.Reader, out interface{}) (http.Header, error) {
+	target := c.url + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if len(c.username) > 0 {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		apiErr := &dataplaneError{Status: resp.StatusCode, Message: strings.TrimSpace(string(raw))}
+		answer := struct {
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(raw, &answer) == nil && len(answer.Message) > 0 {
+			apiErr.Message = answer.Message
+		}
+		return resp.Header, fmt.Errorf("%s %s: %w", method, path, apiErr)
+	}
+	if out != nil && len(raw) > 0 {
+		err = json.Unmarshal(raw, out)
+		if err != nil {
+			return resp.Header, fmt.Errorf("unable to decode answer to %s %s: %w", method, path, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+// version returns the configuration version from the version header, falling
+// back to the body for APIs that do not send it.
+func (c *dataplaneClient) version() (int64, error) {
+	var version int64
+	header, err := c.do(http.MethodGet, dataplaneConfigurationPath+"version", nil, nil, &version)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get config version: %w", err)
+	}
+	if raw := header.Get(dataplaneVersionHeader); len(raw) > 0 {
+		version, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s header %q", dataplaneVersionHeader, raw)
+		}
+	}
+	return version, nil
+}
+
+// transactionError marks the answers the Data Plane API gives to a stale
+// version as a version conflict, so the reconcile is retried.
+func transactionError(action string, err error) error {
+	switch dataplaneStatus(err) {
+	case http.StatusConflict, http.StatusNotAcceptable:
+		return fmt.Errorf("unable to %s transaction: %w: %s", action, errVersionConflict, err)
+	}
+	return fmt.Errorf("unable to %s transaction: %w", action, err)
+}
+
+func (c *dataplaneClient) startTransaction(version int64) (string, error) {
+	transaction := models.Transaction{}
+	query := url.Values{"version": {strconv.FormatInt(version, 10)}}
+	_, err := c.do(http.MethodPost, dataplaneTransactionsPath, query, nil, &transaction)
+	if err != nil {
+		return "", transactionError("start", err)
+	}
+	return transaction.ID, nil
+}
+
+func (c *dataplaneClient) commitTransaction(id string, forceReload bool) error {
+	query := url.Values{}
+	if forceReload {
+		query.Set("force_reload", "true")
+	}
+	_, err := c.do(http.MethodPut, dataplaneTransactionsPath+"/"+id, query, nil, nil)
+	if err != nil {
+		return transactionError("commit", err)
+	}
+	return nil
+}
+
+func (c *dataplaneClient) deleteTransaction(id string) error {
+	_, err := c.do(http.MethodDelete, dataplaneTransactionsPath+"/"+id, nil, nil, nil)
+	return err
+}
+
+// rawConfiguration returns the configuration file as seen by transactionID,
+// or as committed if it is empty.
+func (c *dataplaneClient) rawConfiguration(transactionID string) (string, error) {
+	query := url.Values{}
+	if len(transactionID) > 0 {
+		query.Set("transaction_id", transactionID)
+	}
+	answer := struct {
+		Data string `json:"data"`
+	}{}
+	_, err := c.do(http.MethodGet, dataplaneConfigurationPath+"raw", query, nil, &answer)
+	if err != nil {
+		return "", fmt.Errorf("unable to get configuration: %w", err)
+	}
+	return answer.Data, nil
+}
+
+// deleteMap removes the runtime map at path and its file.
+func (c *dataplaneClient) deleteMap(path string) error {
+	query := url.Values{"forceDelete": {"true"}, "forceSync": {"true"}}
+	_, err := c.do(http.MethodDelete, dataplaneMapsPath+"/"+url.PathEscape(filepath.Base(path)), query, nil, nil)
+	return err
+}
+
+// dataplaneTCPRequestRule is the Data Plane API v2 form of a TCP request
+// rule, which is positioned by index and takes the arguments of the
+// track-sc0 and sc-inc-gpc0 actions in fields of their own.
+type dataplaneTCPRequestRule struct {
+	Index      *int64 `json:"index"`
+	Type       string `json:"type"`
+	Action     string `json:"action,omitempty"`
+	Cond       string `json:"cond,omitempty"`
+	CondTest   string `json:"cond_test,omitempty"`
+	Timeout    *int64 `json:"timeout,omitempty"`
+	TrackKey   string `json:"track_key,omitempty"`
+	TrackTable string `json:"track_table,omitempty"`
+	ScIncID    string `json:"sc_inc_id,omitempty"`
+}
+
+func newDataplaneTCPRequestRule(rule *models.TCPRequestRule) *dataplaneTCPRequestRule {
+	converted := &dataplaneTCPRequestRule{
+		Index:    rule.ID,
+		Type:     rule.Type,
+		Action:   rule.Action,
+		Cond:     rule.Cond,
+		CondTest: rule.CondTest,
+		Timeout:  rule.Timeout,
+	}
+	fields := strings.Fields(rule.Action)
+	switch {
+	case len(fields) == 4 && fields[0] == "track-sc0" && fields[2] == "table":
+		converted.Action = fields[0]
+		converted.TrackKey = fields[1]
+		converted.TrackTable = fields[3]
+	case strings.HasPrefix(rule.Action, "sc-inc-gpc0(") && strings.HasSuffix(rule.Action, ")"):
+		converted.Action = "sc-inc-gpc0"
+		converted.ScIncID = strings.TrimSuffix(strings.TrimPrefix(rule.Action, "sc-inc-gpc0("), ")")
+	}
+	return converted
+}
+
+// model returns the rule with the arguments folded back into its action, as
+// the other outputs write it.
+func (r *dataplaneTCPRequestRule) model() *models.TCPRequestRule {
+	rule := &models.TCPRequestRule{
+		ID:       r.Index,
+		Type:     r.Type,
+		Action:   r.Action,
+		Cond:     r.Cond,
+		CondTest: r.CondTest,
+		Timeout:  r.Timeout,
+	}
+	switch {
+	case len(r.TrackKey) > 0:
+		rule.Action = strings.Join([]string{rule.Action, r.TrackKey, "table", r.TrackTable}, " ")
+	case len(r.ScIncID) > 0:
+		rule.Action = fmt.Sprintf("%s(%s)", rule.Action, r.ScIncID)
+	}
+	return rule
+}
+
+// dataplaneSwitchingRule is the Data Plane API v2 form of a backend
+// switching rule.
+type dataplaneSwitchingRule struct {
+	Index    *int64 `json:"index"`
+	Name     string `json:"name"`
+	Cond     string `json:"cond,omitempty"`
+	CondTest string `json:"cond_test,omitempty"`
+}
+
+func newDataplaneSwitchingRule(rule *models.BackendSwitchingRule) *dataplaneSwitchingRule {
+	return &dataplaneSwitchingRule{Index: rule.ID, Name: rule.Name, Cond: rule.Cond, CondTest: rule.CondTest}
+}
+
+func (r *dataplaneSwitchingRule) model() *models.BackendSwitchingRule {
+	return &models.BackendSwitchingRule{ID: r.Index, Name: r.Name, Cond: r.Cond, CondTest: r.CondTest}
+}
+
+// dataplaneStickRule is the Data Plane API v2 form of a stick rule.
+type dataplaneStickRule struct {
+	Index    *int64 `json:"index"`
+	Type     string `json:"type"`
+	Pattern  string `json:"pattern"`
+	Table    string `json:"table,omitempty"`
+	Cond     string `json:"cond,omitempty"`
+	CondTest string `json:"cond_test,omitempty"`
+}
+
+func newDataplaneStickRule(rule *models.StickRule) *dataplaneStickRule {
+	return &dataplaneStickRule{
+		Index:    rule.ID,
+		Type:     rule.Type,
+		Pattern:  rule.Pattern,
+		Table:    rule.Table,
+		Cond:     rule.Cond,
+		CondTest: rule.CondTest,
+	}
+}
+
+func (r *dataplaneStickRule) model() *models.StickRule {
+	return &models.StickRule{
+		ID:       r.Index,
+		Type:     r.Type,
+		Pattern:  r.Pattern,
+		Table:    r.Table,
+		Cond:     r.Cond,
+		CondTest: r.CondTest,
+	}
+}
+
+// dataplaneOutput pushes the model to a remote HAProxy through its Data Plane
+// API, which validates and reloads the configuration itself. SNI maps are
+// managed with the runtime map endpoints and are named after their file in
+// the maps directory of the Data Plane API, which map-dir must match.
+type dataplaneOutput struct {
+	client *dataplaneClient
+}
+
+// dataplaneReconciler applies a haproxyModel within one Data Plane API
+// transaction. It shares change recording, ownership by prefix and dry run
+// map bookkeeping with reconciler, whose configuration client stays unset.
+type dataplaneReconciler struct {
+	reconciler
+	client *dataplaneClient
+
+	// forceReload is set when a map had to be replaced as a whole, which
+	// running HAProxy only picks up on reload.
+	forceReload bool
+
+	// createdMaps are uploaded before the commit and removed again if it
+	// fails, replacedMaps hold the previous content of the maps replaced
+	// before the commit to upload it again if it fails. mapUpdates are
+	// applied to the running HAProxy and staleMaps removed only after the
+	// commit succeeded.
+	createdMaps  []string
+	replacedMaps map[string][]byte
+	mapUpdates   []mapUpdate
+	staleMaps    []string
+}
+
+func (o *dataplaneOutput) apply(desired *haproxyModel) (*reconcileResult, error) {
+	var err error
+	for attempt := 1; attempt <= maxTransactionAttempts; attempt++ {
+		var result *reconcileResult
+		result, err = o.transaction(desired, nil)
+		if !isVersionConflict(err) {
+			return result, err
+		}
+		logrus.Warnf("attempt %d of %d: %s", attempt, maxTransactionAttempts, err)
+	}
+	return nil, err
+}
+
+func (o *dataplaneOutput) plan(desired *haproxyModel, out io.Writer) (*reconcileResult, error) {
+	return o.transaction(desired, out)
+}
+
+// transaction applies desired in one transaction. With out set, nothing is
+// committed or uploaded and the diff of the configuration and maps is
+// written to out instead.
+func (o *dataplaneOutput) transaction(desired *haproxyModel, out io.Writer) (*reconcileResult, error) {
+	version, err := o.client.version()
+	if err != nil {
+		return nil, err
+	}
+	transactionID, err := o.client.startTransaction(version)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &dataplaneReconciler{
+		reconciler: reconciler{
+			transactionID: transactionID,
+			ownership:     desired.Ownership,
+			mapBackups:    map[string][]byte{},
+			dryRun:        out != nil,
+			mapContents:   map[string][]byte{},
+		},
+		client:       o.client,
+		replacedMaps: map[string][]byte{},
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			o.client.deleteTransaction(transactionID)
+			r.restoreMaps()
+		}
+	}()
+	err = r.apply(desired)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.result.Changes) == 0 {
+		return &r.result, nil
+	}
+	if out != nil {
+		return &r.result, r.writeDiff(out)
+	}
+
+	err = o.client.commitTransaction(transactionID, r.forceReload)
+	if err != nil {
+		return nil, err
+	}
+	committed = true
+	for _, update := range r.mapUpdates {
+		err = r.applyMapUpdate(update)
+		if err != nil {
+			return nil, fmt.Errorf("configuration committed, but %w", err)
+		}
+	}
+	for _, path := range r.staleMaps {
+		err = o.client.deleteMap(path)
+		if err != nil && dataplaneStatus(err) != http.StatusNotFound {
+			logrus.Warnf("unable to delete map %s: %s", path, err)
+		}
+	}
+	return &r.result, nil
+}
+
+// configFile is empty, the Data Plane API restores a configuration that
+// fails its own validation.
+func (o *dataplaneOutput) configFile() string {
+	return ""
+}
+
+func (o *dataplaneOutput) checkFiles() []string {
+	return nil
+}
+
+func (r *dataplaneReconciler) query(pairs ...string) url.Values {
+	query := url.Values{"transaction_id": {r.transactionID}}
+	for idx := 0; idx+1 < len(pairs); idx += 2 {
+		query.Set(pairs[idx], pairs[idx+1])
+	}
+	return query
+}
+
+// list decodes the configuration objects of resource into out.
+func (r *dataplaneReconciler) list(resource string, query url.Values, out interface{}) error {
+	answer := struct {
+		Data interface{} `json:"data"`
+	}{Data: out}
+	_, err := r.client.do(http.MethodGet, dataplaneConfigurationPath+resource, query, nil, &answer)
+	if err != nil {
+		return fmt.Errorf("unable to get %s: %w", resource, err)
+	}
+	return nil
+}
+
+func (r *dataplaneReconciler) create(resource string, query url.Values, object interface{}) error {
+	_, err := r.client.do(http.MethodPost, dataplaneConfigurationPath+resource, query, object, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", resource, err)
+	}
+	return nil
+}
+
+func (r *dataplaneReconciler) replace(resource string, name string, query url.Values, object interface{}) error {
+	_, err := r.client.do(http.MethodPut, dataplaneConfigurationPath+resource+"/"+url.PathEscape(name), query, object, nil)
+	if err != nil {
+		return fmt.Errorf("unable to update %s %s: %w", resource, name, err)
+	}
+	return nil
+}
+
+func (r *dataplaneReconciler) remove(resource string, name string, query url.Values) error {
+	_, err := r.client.do(http.MethodDelete, dataplaneConfigurationPath+resource+"/"+url.PathEscape(name), query, nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to delete %s %s: %w", resource, name, err)
+	}
+	return nil
+}
+
+// replaceRules rewrites the current rules of resource, last first, with the
+// desired slice of rules in order. Rule order is significant, so the list is
+// replaced as a whole.
+func (r *dataplaneReconciler) replaceRules(resource string, query url.Values, current int, desired interface{}) error {
+	for idx := current - 1; idx >= 0; idx-- {
+		err := r.remove(resource, strconv.Itoa(idx), query)
+		if err != nil {
+			return err
+		}
+	}
+	rules := reflect.ValueOf(desired)
+	for idx := 0; idx < rules.Len(); idx++ {
+		err := r.create(resource, query, rules.Index(idx).Interface())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply creates the maps and backends before the frontends that use them and
+// removes stale frontends before the backends they referenced. Only sections
+// carrying the ownership prefix are ever changed or deleted.
+func (r *dataplaneReconciler) apply(desired *haproxyModel) error {
+	for _, frontend := range desired.Frontends {
+		if frontend.SNIMap == nil {
+			continue
+		}
+		for _, file := range frontend.SNIMap.files() {
+			err := r.syncMap(file)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	backends := models.Backends{}
+	err := r.list("backends", r.query(), &backends)
+	if err != nil {
+		return err
+	}
+	currentBackends := map[string]*models.Backend{}
+	for _, backend := range backends {
+		currentBackends[backend.Name] = backend
+	}
+	for _, backend := range desired.Backends {
+		err = r.syncBackend(backend, currentBackends[backend.Backend.Name])
+		if err != nil {
+			return err
+		}
+	}
+
+	frontends := models.Frontends{}
+	err = r.list("frontends", r.query(), &frontends)
+	if err != nil {
+		return err
+	}
+	currentFrontends := map[string]*models.Frontend{}
+	for _, frontend := range frontends {
+		currentFrontends[frontend.Name] = frontend
+	}
+	for _, frontend := range desired.Frontends {
+		err = r.syncFrontend(frontend, currentFrontends[frontend.Frontend.Name])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, frontend := range frontends {
+		if desired.frontend(frontend.Name) != nil {
+			continue
+		}
+		if owned, _ := r.owned(parser.Frontends, frontend.Name); !owned {
+			continue
+		}
+		rules := []*dataplaneSwitchingRule{}
+		err = r.list("backend_switching_rules", r.query("frontend", frontend.Name), &rules)
+		if err != nil {
+			return err
+		}
+		err = r.remove("frontends", frontend.Name, r.query())
+		if err != nil {
+			return err
+		}
+		r.record("delete frontend %s", frontend.Name)
+		for _, rule := range rules {
+			if match := mapRulePattern.FindStringSubmatch(rule.Name); match != nil {
+				r.removeMap(match[1])
+			}
+		}
+	}
+
+	for _, backend := range backends {
+		if desired.backend(backend.Name) != nil || desired.defaultBackend(backend.Name) {
+			continue
+		}
+		if owned, _ := r.owned(parser.Backends, backend.Name); !owned {
+			continue
+		}
+		err = r.remove("backends", backend.Name, r.query())
+		if err != nil {
+			return err
+		}
+		r.record("delete backend %s", backend.Name)
+	}
+	return nil
+}
+
+func (r *dataplaneReconciler) syncBackend(desired *backendModel, current *models.Backend) error {
+	name := desired.Backend.Name
+	var err error
+	if current == nil {
+		err = r.create("backends", r.query(), &desired.Backend)
+		if err != nil {
+			return err
+		}
+		r.record("create backend %s", name)
+	} else if err = r.claim(parser.Backends, name); err != nil {
+		return err
+	} else if !reflect.DeepEqual(*current, desired.Backend) {
+		err = r.replace("backends", name, r.query(), &desired.Backend)
+		if err != nil {
+			return err
+		}
+		r.record("update backend %s", name)
+	}
+
+	currentStickRules := []*dataplaneStickRule{}
+	err = r.list("stick_rules", r.query("backend", name), &currentStickRules)
+	if err != nil {
+		return err
+	}
+	stickRules := models.StickRules{}
+	for _, rule := range currentStickRules {
+		stickRules = append(stickRules, rule.model())
+	}
+	if (len(stickRules) > 0 || len(desired.StickRules) > 0) && !reflect.DeepEqual(stickRules, desired.StickRules) {
+		desiredStickRules := []*dataplaneStickRule{}
+		for _, rule := range desired.StickRules {
+			desiredStickRules = append(desiredStickRules, newDataplaneStickRule(rule))
+		}
+		err = r.replaceRules("stick_rules", r.query("backend", name), len(stickRules), desiredStickRules)
+		if err != nil {
+			return err
+		}
+		r.record("replace stick rules of %s", name)
+	}
+
+	currentServers := models.Servers{}
+	err = r.list("servers", r.query("backend", name), &currentServers)
+	if err != nil {
+		return err
+	}
+	existing := map[string]*models.Server{}
+	for _, server := range currentServers {
+		existing[server.Name] = server
+	}
+	wanted := map[string]bool{}
+	for _, server := range stabilizeSlots(desired.Servers, currentServers) {
+		wanted[server.Name] = true
+		currentServer, ok := existing[server.Name]
+		if !ok {
+			err = r.create("servers", r.query("backend", name), server)
+			if err != nil {
+				return err
+			}
+			r.record("create server %s/%s", name, server.Name)
+		} else if !reflect.DeepEqual(currentServer, server) {
+			err = r.replace("servers", server.Name, r.query("backend", name), server)
+			if err != nil {
+				return err
+			}
+			r.record("update server %s/%s", name, server.Name)
+		}
+	}
+	for _, server := range currentServers {
+		if wanted[server.Name] {
+			continue
+		}
+		err = r.remove("servers", server.Name, r.query("backend", name))
+		if err != nil {
+			return err
+		}
+		r.record("delete server %s/%s", name, server.Name)
+	}
+	return nil
+}
+
+func (r *dataplaneReconciler) syncFrontend(desired *frontendModel, current *models.Frontend) error {
+	name := desired.Frontend.Name
+	var err error
+	if current == nil {
+		err = r.create("frontends", r.query(), &desired.Frontend)
+		if err != nil {
+			return err
+		}
+		r.record("create frontend %s", name)
+	} else if err = r.claim(parser.Frontends, name); err != nil {
+		return err
+	} else if !reflect.DeepEqual(*current, desired.Frontend) {
+		err = r.replace("frontends", name, r.query(), &desired.Frontend)
+		if err != nil {
+			return err
+		}
+		r.record("update frontend %s", name)
+	}
+
+	binds := models.Binds{}
+	err = r.list("binds", r.query("frontend", name), &binds)
+	if err != nil {
+		return err
+	}
+	existing := map[string]*models.Bind{}
+	for _, bind := range binds {
+		existing[bind.Name] = bind
+	}
+	wanted := map[string]bool{}
+	for _, bind := range desired.Binds {
+		wanted[bind.Name] = true
+		currentBind, ok := existing[bind.Name]
+		if !ok {
+			err = r.create("binds", r.query("frontend", name), bind)
+			if err != nil {
+				return err
+			}
+			r.record("create bind %s/%s", name, bind.Name)
+		} else if !reflect.DeepEqual(currentBind, bind) {
+			err = r.replace("binds", bind.Name, r.query("frontend", name), bind)
+			if err != nil {
+				return err
+			}
+			r.record("update bind %s/%s", name, bind.Name)
+		}
+	}
+	for _, bind := range binds {
+		if wanted[bind.Name] {
+			continue
+		}
+		err = r.remove("binds", bind.Name, r.query("frontend", name))
+		if err != nil {
+			return err
+		}
+		r.record("delete bind %s/%s", name, bind.Name)
+	}
+
+	currentTCPRules := []*dataplaneTCPRequestRule{}
+	tcpQuery := r.query("parent_type", "frontend", "parent_name", name)
+	err = r.list("tcp_request_rules", tcpQuery, &currentTCPRules)
+	if err != nil {
+		return err
+	}
+	tcpRules := models.TCPRequestRules{}
+	for _, rule := range currentTCPRules {
+		tcpRules = append(tcpRules, rule.model())
+	}
+	if (len(tcpRules) > 0 || len(desired.TCPRequestRules) > 0) && !reflect.DeepEqual(tcpRules, desired.TCPRequestRules) {
+		desiredTCPRules := []*dataplaneTCPRequestRule{}
+		for _, rule := range desired.TCPRequestRules {
+			desiredTCPRules = append(desiredTCPRules, newDataplaneTCPRequestRule(rule))
+		}
+		err = r.replaceRules("tcp_request_rules", tcpQuery, len(tcpRules), desiredTCPRules)
+		if err != nil {
+			return err
+		}
+		r.record("replace TCP request rules of %s", name)
+	}
+
+	currentSwitchingRules := []*dataplaneSwitchingRule{}
+	err = r.list("backend_switching_rules", r.query("frontend", name), &currentSwitchingRules)
+	if err != nil {
+		return err
+	}
+	switchingRules := models.BackendSwitchingRules{}
+	for _, rule := range currentSwitchingRules {
+		switchingRules = append(switchingRules, rule.model())
+	}
+	if !reflect.DeepEqual(switchingRules, desired.SwitchingRules) {
+		desiredSwitchingRules := []*dataplaneSwitchingRule{}
+		for _, rule := range desired.SwitchingRules {
+			desiredSwitchingRules = append(desiredSwitchingRules, newDataplaneSwitchingRule(rule))
+		}
+		err = r.replaceRules("backend_switching_rules", r.query("frontend", name), len(switchingRules), desiredSwitchingRules)
+		if err != nil {
+			return err
+		}
+		r.record("replace backend switching rules of %s", name)
+	}
+	return nil
+}
+
+// currentMap returns the entries of the runtime map at path in file order,
+// or nil if the Data Plane API does not know it.
+func (r *dataplaneReconciler) currentMap(path string) (*mapFile, error) {
+	entries := []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}{}
+	_, err := r.client.do(http.MethodGet, dataplaneMapEntriesPath, url.Values{"map": {filepath.Base(path)}}, nil, &entries)
+	if dataplaneStatus(err) == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get map %s: %w", path, err)
+	}
+	current := &mapFile{Path: path}
+	for _, entry := range entries {
+		current.Entries = append(current.Entries, mapEntry{Key: entry.Key, Backend: entry.Value})
+	}
+	return current, nil
+}
+
+// syncMap brings the runtime map of a frontend in line with desired. Entry
+// changes are applied one by one once the transaction is committed and
+// synced to the map file by the Data Plane API. A map whose entries must be
+// reordered is replaced as a whole before the commit, which reloads HAProxy,
+// and put back if the commit fails.
+func (r *dataplaneReconciler) syncMap(desired *mapFile) error {
+	current, err := r.currentMap(desired.Path)
+	if err != nil {
+		return err
+	}
+	content := desired.render()
+	if current != nil && bytes.Equal(current.render(), content) {
+		return nil
+	}
+	if r.dryRun {
+		if current != nil {
+			r.mapBackups[desired.Path] = current.render()
+		}
+		r.mapContents[desired.Path] = content
+	}
+	if current == nil {
+		r.record("create map %s", desired.Path)
+		if r.dryRun {
+			return nil
+		}
+		err = r.uploadMap(desired.Path, content)
+		if err == nil {
+			r.createdMaps = append(r.createdMaps, desired.Path)
+		}
+		return err
+	}
+
+	updates := diffMap(current, desired)
+	replace := len(updates) == 0
+	for _, update := range updates {
+		if shadow := current.shadowingEntry(update); len(shadow) > 0 {
+			replace = true
+		}
+	}
+	if replace {
+		r.record("replace map %s", desired.Path)
+		r.forceReload = true
+		if r.dryRun {
+			return nil
+		}
+		err = r.client.deleteMap(desired.Path)
+		if err != nil {
+			return fmt.Errorf("unable to replace map %s: %w", desired.Path, err)
+		}
+		r.replacedMaps[desired.Path] = current.render()
+		return r.uploadMap(desired.Path, content)
+	}
+
+	for _, update := range updates {
+		r.result.Changes = append(r.result.Changes, update.String())
+	}
+	r.mapUpdates = append(r.mapUpdates, updates...)
+	return nil
+}
+
+func (r *dataplaneReconciler) applyMapUpdate(update mapUpdate) error {
+	query := url.Values{"map": {filepath.Base(update.Path)}, "force_sync": {"true"}}
+	entry := map[string]string{"key": update.Key, "value": update.Backend}
+	entryPath := dataplaneMapEntriesPath + "/" + url.PathEscape(update.Key)
+	var err error
+	switch {
+	case len(update.Backend) == 0:
+		_, err = r.client.do(http.MethodDelete, entryPath, query, nil, nil)
+	case update.Exists:
+		_, err = r.client.do(http.MethodPut, entryPath, query, entry, nil)
+	default:
+		_, err = r.client.do(http.MethodPost, dataplaneMapEntriesPath, query, entry, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to %s: %w", update, err)
+	}
+	return nil
+}
+
+// uploadMap creates the map file for path in the maps directory of the Data
+// Plane API.
+func (r *dataplaneReconciler) uploadMap(path string, content []byte) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("fileUpload", filepath.Base(path))
+	if err == nil {
+		_, err = part.Write(content)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = r.client.send(http.MethodPost, dataplaneMapsPath, nil, writer.FormDataContentType(), &body, nil)
+	if err != nil {
+		return fmt.Errorf("unable to upload map %s: %w", path, err)
+	}
+	return nil
+}
+
+// removeMap deletes the map of a deleted frontend once the transaction is
+// committed.
+func (r *dataplaneReconciler) removeMap(path string) {
+	r.record("delete map %s", path)
+	if r.dryRun {
+		current, err := r.currentMap(path)
+		if err == nil && current != nil {
+			r.mapBackups[path] = current.render()
+			r.mapContents[path] = nil
+		}
+		return
+	}
+	r.staleMaps = append(r.staleMaps, path)
+}
+
+// restoreMaps undoes the map changes made for a transaction that was not
+// committed: created maps are deleted and replaced maps uploaded again with
+// their previous content. Entry updates were not applied yet.
+func (r *dataplaneReconciler) restoreMaps() {
+	for _, path := range r.createdMaps {
+		err := r.client.deleteMap(path)
+		if err != nil {
+			logrus.Warnf("unable to remove map %s: %s", path, err)
+		}
+	}
+	for path, content := range r.replacedMaps {
+		err := r.client.deleteMap(path)
+		if err == nil {
+			err = r.uploadMap(path, content)
+		}
+		if err != nil {
+			logrus.Warnf("unable to restore map %s: %s", path, err)
+		}
+	}
+}
+
+// writeDiff writes the diff between the committed configuration and the one
+// in the transaction, followed by the map diffs, to out.
+func (r *dataplaneReconciler) writeDiff(out io.Writer) error {
+	current, err := r.client.rawConfiguration("")
+	if err != nil {
+		return err
+	}
+	planned, err := r.client.rawConfiguration(r.transactionID)
+	if err != nil {
+		return err
+	}
+	_, err = writeUnifiedDiff(out, r.client.url, r.client.url, current, planned)
+	if err != nil {
+		return err
+	}
+	return writeMapDiffs(out, &r.reconciler)
+}
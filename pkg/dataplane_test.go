@@ -0,0 +1,523 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/haproxytech/models"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+// stubConfig holds the configuration objects of a stub Data Plane API, keyed
+// by resource and parent name.
+type stubConfig map[string][]map[string]interface{}
+
+func (c stubConfig) copy() stubConfig {
+	raw, _ := json.Marshal(c)
+	copied := stubConfig{}
+	json.Unmarshal(raw, &copied)
+	return copied
+}
+
+func (c stubConfig) render() string {
+	keys := []string{}
+	for key := range c {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf strings.Builder
+	for _, key := range keys {
+		for _, object := range c[key] {
+			raw, _ := json.Marshal(object)
+			fmt.Fprintf(&buf, "%s %s\n", key, raw)
+		}
+	}
+	return buf.String()
+}
+
+// stubTransaction is a copy of the configuration taken at Version.
+type stubTransaction struct {
+	Version int64
+	Config  stubConfig
+}
+
+var stubRuleResources = map[string]bool{
+	"tcp_request_rules":       true,
+	"backend_switching_rules": true,
+	"stick_rules":             true,
+}
+
+// stubDataplane is an in-memory Data Plane API serving the endpoints the
+// dataplane output uses.
+type stubDataplane struct {
+	mu           sync.Mutex
+	version      int64
+	config       stubConfig
+	transactions map[string]*stubTransaction
+	maps         map[string][]mapEntry
+	commits      []string
+
+	// beforeCommit, if set, runs before a commit is checked.
+	beforeCommit func(s *stubDataplane)
+
+	// commitError, if set, fails every commit as invalid.
+	commitError string
+}
+
+func newStubDataplane(t *testing.T) (*stubDataplane, *data.OutputConfig) {
+	stub := &stubDataplane{
+		version:      1,
+		config:       stubConfig{},
+		transactions: map[string]*stubTransaction{},
+		maps:         map[string][]mapEntry{},
+	}
+	server := httptest.NewServer(http.StripPrefix("/v2", stub))
+	t.Cleanup(server.Close)
+	return stub, &data.OutputConfig{Type: OutputDataplane, URL: server.URL + "/v2/", Username: "admin", Password: "secret"}
+}
+
+func stubAnswer(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func stubError(w http.ResponseWriter, status int, message string) {
+	stubAnswer(w, status, map[string]interface{}{"code": status, "message": message})
+}
+
+func (s *stubDataplane) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "secret" {
+		stubError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	w.Header().Set(dataplaneVersionHeader, strconv.FormatInt(s.version, 10))
+	query := r.URL.Query()
+	switch {
+	case r.URL.Path == dataplaneConfigurationPath+"version":
+		stubAnswer(w, http.StatusOK, s.version)
+	case r.URL.Path == dataplaneConfigurationPath+"raw":
+		config := s.config
+		if transaction, ok := s.transactions[query.Get("transaction_id")]; ok {
+			config = transaction.Config
+		}
+		stubAnswer(w, http.StatusOK, map[string]interface{}{"_version": s.version, "data": config.render()})
+	case strings.HasPrefix(r.URL.Path, dataplaneTransactionsPath):
+		s.serveTransaction(w, r)
+	case strings.HasPrefix(r.URL.Path, dataplaneMapEntriesPath):
+		s.serveMapEntries(w, r)
+	case strings.HasPrefix(r.URL.Path, dataplaneMapsPath):
+		s.serveMaps(w, r)
+	case strings.HasPrefix(r.URL.Path, dataplaneConfigurationPath):
+		s.serveConfiguration(w, r)
+	default:
+		stubError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+func (s *stubDataplane) serveTransaction(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, dataplaneTransactionsPath), "/")
+	switch r.Method {
+	case http.MethodPost:
+		if r.URL.Query().Get("version") != strconv.FormatInt(s.version, 10) {
+			stubError(w, http.StatusConflict, "version mismatch")
+			return
+		}
+		id = fmt.Sprintf("tx-%d", len(s.transactions)+len(s.commits)+1)
+		s.transactions[id] = &stubTransaction{Version: s.version, Config: s.config.copy()}
+		stubAnswer(w, http.StatusCreated, models.Transaction{ID: id, Version: s.version, Status: "in_progress"})
+	case http.MethodPut:
+		if s.beforeCommit != nil {
+			s.beforeCommit(s)
+			s.beforeCommit = nil
+		}
+		transaction, ok := s.transactions[id]
+		if !ok {
+			stubError(w, http.StatusNotFound, "no such transaction")
+			return
+		}
+		delete(s.transactions, id)
+		if len(s.commitError) > 0 {
+			stubError(w, http.StatusBadRequest, s.commitError)
+			return
+		}
+		if transaction.Version != s.version {
+			stubError(w, http.StatusNotAcceptable, "transaction outdated")
+			return
+		}
+		s.config = transaction.Config
+		s.version++
+		s.commits = append(s.commits, r.URL.RawQuery)
+		stubAnswer(w, http.StatusOK, models.Transaction{ID: id, Version: s.version, Status: "success"})
+	case http.MethodDelete:
+		delete(s.transactions, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *stubDataplane) serveConfiguration(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, dataplaneConfigurationPath), "/", 2)
+	resource := parts[0]
+	query := r.URL.Query()
+	key := resource
+	for _, parent := range []string{"backend", "frontend", "parent_name"} {
+		if value := query.Get(parent); len(value) > 0 {
+			key = resource + "/" + value
+		}
+	}
+	config := s.config
+	if id := query.Get("transaction_id"); len(id) > 0 {
+		transaction, ok := s.transactions[id]
+		if !ok {
+			stubError(w, http.StatusNotFound, "no such transaction")
+			return
+		}
+		config = transaction.Config
+	} else if r.Method != http.MethodGet {
+		stubError(w, http.StatusBadRequest, "transaction_id is required")
+		return
+	}
+
+	objects := config[key]
+	index := -1
+	if len(parts) == 2 {
+		for idx, object := range objects {
+			if object["name"] == parts[1] || (stubRuleResources[resource] && strconv.Itoa(idx) == parts[1]) {
+				index = idx
+			}
+		}
+		if index < 0 {
+			stubError(w, http.StatusNotFound, "no such object")
+			return
+		}
+	}
+
+	object := map[string]interface{}{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&object)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if objects == nil {
+			objects = []map[string]interface{}{}
+		}
+		stubAnswer(w, http.StatusOK, map[string]interface{}{"_version": s.version, "data": objects})
+		return
+	case http.MethodPost:
+		if !stubRuleResources[resource] {
+			for _, existing := range objects {
+				if existing["name"] == object["name"] {
+					stubError(w, http.StatusConflict, "object exists")
+					return
+				}
+			}
+		}
+		if stubRuleResources[resource] {
+			position, ok := object["index"].(float64)
+			if !ok || position < 0 || int(position) > len(objects) {
+				stubError(w, http.StatusUnprocessableEntity, "index is required")
+				return
+			}
+			objects = append(objects[:int(position)], append([]map[string]interface{}{object}, objects[int(position):]...)...)
+			stubRenumber(objects)
+		} else {
+			objects = append(objects, object)
+		}
+	case http.MethodPut:
+		objects[index] = object
+	case http.MethodDelete:
+		objects = append(objects[:index], objects[index+1:]...)
+		if stubRuleResources[resource] {
+			stubRenumber(objects)
+		}
+		if resource == "backends" || resource == "frontends" {
+			for child := range config {
+				if strings.HasSuffix(child, "/"+parts[1]) {
+					delete(config, child)
+				}
+			}
+		}
+	}
+	config[key] = objects
+	stubAnswer(w, http.StatusAccepted, object)
+}
+
+// stubRenumber sets the index of each rule to its position, as the Data
+// Plane API does after an insertion or deletion.
+func stubRenumber(rules []map[string]interface{}) {
+	for idx, rule := range rules {
+		rule["index"] = float64(idx)
+	}
+}
+
+func (s *stubDataplane) serveMaps(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		file, header, err := r.FormFile("fileUpload")
+		if err != nil {
+			stubError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, ok := s.maps[header.Filename]; ok {
+			stubError(w, http.StatusConflict, "map exists")
+			return
+		}
+		entries := []mapEntry{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			entries = append(entries, mapEntry{Key: fields[0], Backend: fields[1]})
+		}
+		s.maps[header.Filename] = entries
+		stubAnswer(w, http.StatusCreated, map[string]string{"file": header.Filename})
+	case http.MethodDelete:
+		name := strings.TrimPrefix(r.URL.Path, dataplaneMapsPath+"/")
+		delete(s.maps, name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *stubDataplane) serveMapEntries(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("map")
+	entries, ok := s.maps[name]
+	if !ok {
+		stubError(w, http.StatusNotFound, "no such map")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, dataplaneMapEntriesPath), "/")
+	entry := map[string]string{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&entry)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		answer := []map[string]string{}
+		for _, entry := range entries {
+			answer = append(answer, map[string]string{"key": entry.Key, "value": entry.Backend})
+		}
+		stubAnswer(w, http.StatusOK, answer)
+		return
+	case http.MethodPost:
+		entries = append(entries, mapEntry{Key: entry["key"], Backend: entry["value"]})
+	case http.MethodPut:
+		for idx := range entries {
+			if entries[idx].Key == key {
+				entries[idx].Backend = entry["value"]
+			}
+		}
+	case http.MethodDelete:
+		kept := []mapEntry{}
+		for _, existing := range entries {
+			if existing.Key != key {
+				kept = append(kept, existing)
+			}
+		}
+		entries = kept
+	}
+	s.maps[name] = entries
+	stubAnswer(w, http.StatusOK, entry)
+}
+
+func (s *stubDataplane) names(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := []string{}
+	for _, object := range s.config[key] {
+		names = append(names, fmt.Sprint(object["name"]))
+	}
+	return names
+}
+
+func testDataplaneMonitorConfig(t *testing.T) *data.MonitorConfig {
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	monitorConfig.Ownership.Prefix = "dyna-"
+	return monitorConfig
+}
+
+func TestDataplaneOutput(t *testing.T) {
+	stub, config := newStubDataplane(t)
+	stub.config["backends"] = []map[string]interface{}{{"name": "bastion", "mode": "tcp"}}
+	output := &dataplaneOutput{client: newDataplaneClient(config)}
+	monitorConfig := testDataplaneMonitorConfig(t)
+
+	result, err := output.apply(buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) == 0 || len(stub.commits) != 1 {
+		t.Fatalf("expected one commit, got %v and %v", result.Changes, stub.commits)
+	}
+	expected := "bastion dyna-a.example.com-6443 dyna-a.example.com-443 dyna-b.example.com-6443 dyna-unknown-sni"
+	if names := strings.Join(stub.names("backends"), " "); names != expected {
+		t.Errorf("expected backends %s, got %s", expected, names)
+	}
+	if servers := stub.names("servers/dyna-a.example.com-6443"); len(servers) != 4 {
+		t.Errorf("expected 4 server slots, got %v", servers)
+	}
+	mapPath := monitorConfig.MapDir + "/dyna-frontend-16443.map"
+	rules := stub.config["backend_switching_rules/dyna-frontend-16443"]
+	if len(rules) != 2 || rules[0]["name"] != mapSwitchingRules(sniSample, mapPath)[0].Name || rules[1]["name"] != mapSwitchingRules(sniSample, mapPath)[1].Name {
+		t.Errorf("unexpected switching rules %v", rules)
+	}
+	tcpRules := stub.config["tcp_request_rules/dyna-frontend-16443"]
+	if len(tcpRules) != 5 || tcpRules[1]["action"] != "track-sc0" || tcpRules[1]["track_table"] != "dyna-unknown-sni" || tcpRules[2]["sc_inc_id"] != "0" {
+		t.Errorf("unexpected TCP request rules %v", tcpRules)
+	}
+	if entries := stub.maps["dyna-frontend-16443.exact.map"]; len(entries) != 2 {
+		t.Errorf("expected the map to be uploaded, got %v", entries)
+	}
+
+	result, err = output.apply(buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) != 0 || len(stub.commits) != 1 {
+		t.Errorf("expected no changes and no commit, got %v", result.Changes)
+	}
+
+	result, err = output.apply(buildModel(testClusters()[1:], monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if names := strings.Join(stub.names("backends"), " "); names != "bastion dyna-b.example.com-6443 dyna-unknown-sni" {
+		t.Errorf("expected stale backends removed and bastion kept, got %s", names)
+	}
+	if entries := stub.maps["dyna-frontend-16443.exact.map"]; len(entries) != 1 || entries[0].Key != "api.b.example.com" {
+		t.Errorf("expected the map entry to be deleted, got %v", entries)
+	}
+	if _, ok := stub.maps["dyna-frontend-10443.map"]; ok {
+		t.Error("expected the map of the removed frontend to be deleted")
+	}
+	if len(stub.transactions) != 0 {
+		t.Errorf("expected no transaction left open, got %v", stub.transactions)
+	}
+}
+
+func TestDataplaneOutputRetriesVersionConflict(t *testing.T) {
+	stub, config := newStubDataplane(t)
+	output := &dataplaneOutput{client: newDataplaneClient(config)}
+	stub.beforeCommit = func(s *stubDataplane) {
+		s.version++
+	}
+
+	result, err := output.apply(buildModel(testClusters(), testDataplaneMonitorConfig(t)))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) == 0 || len(stub.commits) != 1 || stub.version != 3 {
+		t.Errorf("expected the second attempt to commit, got %v at version %d", stub.commits, stub.version)
+	}
+}
+
+func TestDataplaneOutputFailedCommitKeepsMaps(t *testing.T) {
+	stub, config := newStubDataplane(t)
+	output := &dataplaneOutput{client: newDataplaneClient(config)}
+	monitorConfig := testDataplaneMonitorConfig(t)
+
+	_, err := output.apply(buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	before := map[string][]mapEntry{}
+	for name, entries := range stub.maps {
+		before[name] = append([]mapEntry{}, entries...)
+	}
+
+	// Dropping b deletes an entry, a domain nested in the apps of a is
+	// shadowed and replaces the map, and a new port creates a map.
+	clusters := testClusters()[:1]
+	clusters = append(clusters, data.Cluster{
+		BaseDomain: "shard.apps.a.example.com",
+		Ports: []data.MonitorPort{
+			{Port: 443, PathPrefix: "*.apps", Targets: []string{"192.168.90.3"}},
+			{Port: 8443, PathMatch: "api", Targets: []string{"192.168.90.4"}},
+		},
+	})
+	stub.commitError = "invalid configuration"
+	_, err = output.apply(buildModel(clusters, monitorConfig))
+	if err == nil || !strings.Contains(err.Error(), "invalid configuration") {
+		t.Fatalf("expected the commit to fail, got %v", err)
+	}
+	if len(stub.commits) != 1 {
+		t.Errorf("expected no further commit, got %v", stub.commits)
+	}
+	if !reflect.DeepEqual(stub.maps, before) {
+		t.Errorf("expected the maps to be left as committed\n%v\ngot\n%v", before, stub.maps)
+	}
+
+	stub.commitError = ""
+	_, err = output.apply(buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if entries := stub.maps["dyna-frontend-16443.exact.map"]; len(entries) != 1 || entries[0].Key != "api.a.example.com" {
+		t.Errorf("expected the entry to be deleted after the commit, got %v", entries)
+	}
+	if entries := stub.maps["dyna-frontend-10443.map"]; len(entries) != 2 || entries[0].Key != ".apps.shard.apps.a.example.com" {
+		t.Errorf("expected the map to be replaced, got %v", entries)
+	}
+}
+
+func TestDataplaneOutputPlan(t *testing.T) {
+	stub, config := newStubDataplane(t)
+	output := &dataplaneOutput{client: newDataplaneClient(config)}
+
+	var out bytes.Buffer
+	result, err := output.plan(buildModel(testClusters(), testDataplaneMonitorConfig(t)), &out)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) == 0 {
+		t.Fatal("expected pending changes")
+	}
+	for _, expected := range []string{
+		`+backends {"mode":"tcp","name":"dyna-b.example.com-6443"}`,
+		"+++ " + output.client.url,
+		"+api.b.example.com dyna-b.example.com-6443",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in diff:\n%s", expected, out.String())
+		}
+	}
+	if len(stub.commits) != 0 || len(stub.maps) != 0 || len(stub.transactions) != 0 {
+		t.Errorf("expected a plan to leave the API untouched, got %v %v", stub.commits, stub.maps)
+	}
+}
+
+func TestDataplaneError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		stubError(w, http.StatusUnauthorized, "invalid credentials")
+	}))
+	defer server.Close()
+	client := newDataplaneClient(&data.OutputConfig{URL: server.URL})
+	_, err := client.version()
+	if dataplaneStatus(err) != http.StatusUnauthorized || !strings.Contains(err.Error(), "invalid credentials") {
+		t.Errorf("expected the API error to be reported, got %v", err)
+	}
+
+	monitorConfig := &data.MonitorConfig{}
+	if err := validateOutput(&data.OutputConfig{Type: OutputDataplane, URL: server.URL}, monitorConfig); err == nil {
+		t.Error("expected the dataplane output to require an ownership prefix")
+	}
+	monitorConfig.Ownership.Prefix = "dyna-"
+	if err := validateOutput(&data.OutputConfig{Type: OutputDataplane, URL: server.URL}, monitorConfig); err != nil {
+		t.Errorf("failed: %s", err)
+	}
+	if err := validateOutput(&data.OutputConfig{Type: OutputDataplane}, monitorConfig); err == nil {
+		t.Error("expected the dataplane output to require a url")
+	}
+}
@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffKind int
+
+const (
+	diffEqual diffKind = iota
+	diffDelete
+	diffInsert
+)
+
+type diffOp struct {
+	Kind diffKind
+	Line string
+}
+
+// diffLines returns the shortest edit script turning a into b, using the
+// Myers algorithm so large configurations stay cheap to compare.
+func diffLines(a []string, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	trace := [][]int{}
+search:
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int{}, v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	reversed := []diffOp{}
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, diffOp{Kind: diffEqual, Line: a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			reversed = append(reversed, diffOp{Kind: diffInsert, Line: b[y-1]})
+			y--
+		} else {
+			reversed = append(reversed, diffOp{Kind: diffDelete, Line: a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		reversed = append(reversed, diffOp{Kind: diffEqual, Line: a[x-1]})
+		x--
+		y--
+	}
+
+	ops := make([]diffOp, len(reversed))
+	for idx, op := range reversed {
+		ops[len(reversed)-1-idx] = op
+	}
+	return ops
+}
+
+func splitLines(content string) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// hunkRange formats one side of a hunk header. An empty side names the line
+// before the hunk, as diff -u does.
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// writeUnifiedDiff writes the unified diff from before to after to out and
+// reports whether they differ.
+func writeUnifiedDiff(out io.Writer, fromName string, toName string, before string, after string) (bool, error) {
+	ops := diffLines(splitLines(before), splitLines(after))
+	changed := []int{}
+	for idx, op := range ops {
+		if op.Kind != diffEqual {
+			changed = append(changed, idx)
+		}
+	}
+	if len(changed) == 0 {
+		return false, nil
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", fromName, toName)
+	for first := 0; first < len(changed); {
+		last := first
+		for last+1 < len(changed) && changed[last+1]-changed[last] <= 2*diffContext {
+			last++
+		}
+		start := changed[first] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := changed[last] + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		aStart, bStart := 0, 0
+		for _, op := range ops[:start] {
+			if op.Kind != diffInsert {
+				aStart++
+			}
+			if op.Kind != diffDelete {
+				bStart++
+			}
+		}
+		aCount, bCount := 0, 0
+		var lines strings.Builder
+		for _, op := range ops[start:end] {
+			prefix := " "
+			switch op.Kind {
+			case diffDelete:
+				prefix = "-"
+				aCount++
+			case diffInsert:
+				prefix = "+"
+				bCount++
+			default:
+				aCount++
+				bCount++
+			}
+			lines.WriteString(prefix + op.Line + "\n")
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n%s", hunkRange(aStart, aCount), hunkRange(bStart, bCount), lines.String())
+		first = last + 1
+	}
+	_, err := io.WriteString(out, buf.String())
+	return true, err
+}
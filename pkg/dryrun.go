@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/haproxytech/client-native/configuration"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+// planReconcile applies desired in a transaction that is never committed and
+// writes the unified diff of haproxy.cfg, labelled fromName and toName, and
+// of every SNI map it would change to out. Neither the configuration nor the
+// maps are touched.
+func planReconcile(config *configuration.Client, desired *haproxyModel, out io.Writer, fromName, toName string) (*reconcileResult, error) {
+	version, err := config.GetVersion("")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get config version: %w", err)
+	}
+	transaction, err := config.StartTransaction(version)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start transaction: %w", err)
+	}
+	defer config.DeleteTransaction(transaction.ID)
+
+	r := &reconciler{
+		config:        config,
+		transactionID: transaction.ID,
+		ownership:     desired.Ownership,
+		mapBackups:    map[string][]byte{},
+		dryRun:        true,
+		mapContents:   map[string][]byte{},
+	}
+	err = r.apply(desired)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.result.Changes) == 0 {
+		return &r.result, nil
+	}
+
+	current, err := config.GetParser("")
+	if err != nil {
+		return nil, err
+	}
+	planned, err := config.GetParser(transaction.ID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writeUnifiedDiff(out, fromName, toName, current.String(), planned.String())
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeMapDiffs(out, r)
+	if err != nil {
+		return nil, err
+	}
+	return &r.result, nil
+}
+
+// writeMapDiffs writes the unified diff of every map a dry run reconciler
+// would change to out.
+func writeMapDiffs(out io.Writer, r *reconciler) error {
+	paths := []string{}
+	for path := range r.mapContents {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fromName, toName := path, path
+		if r.mapBackups[path] == nil {
+			fromName = "/dev/null"
+		}
+		if r.mapContents[path] == nil {
+			toName = "/dev/null"
+		}
+		_, err := writeUnifiedDiff(out, fromName, toName, string(r.mapBackups[path]), string(r.mapContents[path]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DryRun writes the changes a run would make to the HAProxy configuration,
+// or the include file of the template output, and the SNI maps of every
+// output target to out as a unified diff, without applying them, and reports
+// whether any are pending.
+func DryRun(monitorConfig *data.MonitorConfigSpec, out io.Writer) (bool, error) {
+	targets, err := resolveTargets(&monitorConfig.MonitorConfig)
+	if err != nil {
+		return false, err
+	}
+	pending := false
+	for _, target := range targets {
+		log := target.log()
+		output, cleanup, err := newPlanOutput(target.MonitorConfig)
+		if err != nil {
+			return false, err
+		}
+		defer cleanup()
+		model := buildModel(target.clusters(monitorConfig.MonitorConfig.MonitorRanges), target.MonitorConfig)
+		for _, conflict := range model.Conflicts {
+			log.Warnf("conflicting routes: %s", conflict)
+		}
+		result, err := output.plan(model, out)
+		if err != nil {
+			return false, fmt.Errorf("unable to plan configuration: %w", err)
+		}
+		for _, change := range result.Changes {
+			log.Infof("pending: %s", change)
+		}
+		pending = pending || len(result.Changes) > 0
+	}
+	return pending, nil
+}
+
+// newPlanOutput returns the output of monitorConfig for a dry run. When the
+// haproxy block would bootstrap a missing haproxy.cfg, the plan is made
+// against an empty stand-in in a temporary directory, which cleanup removes,
+// so that nothing is written where HAProxy reads its configuration.
+func newPlanOutput(monitorConfig *data.MonitorConfig) (output, func(), error) {
+	cleanup := func() {}
+	configurationFile := clientParams(&monitorConfig.Client).ConfigurationFile
+	if monitorConfig.Haproxy == nil || !isNotExist(configurationFile) {
+		output, err := newOutput(monitorConfig)
+		return output, cleanup, err
+	}
+
+	dir, err := os.MkdirTemp("", "haproxy-dyna-configure-")
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("unable to create a stand-in for %s: %w", configurationFile, err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	standIn := *monitorConfig
+	standIn.Client.ConfigurationFile = filepath.Join(dir, filepath.Base(configurationFile))
+	err = os.WriteFile(standIn.Client.ConfigurationFile, nil, 0644)
+	if err != nil {
+		cleanup()
+		return nil, func() {}, fmt.Errorf("unable to create a stand-in for %s: %w", configurationFile, err)
+	}
+	output, err := newOutput(&standIn)
+	if err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	if native, ok := output.(*clientNativeOutput); ok {
+		native.bootstrapFile = configurationFile
+	}
+	return output, cleanup, nil
+}
+
+func isNotExist(path string) bool {
+	_, err := os.Stat(path)
+	return os.IsNotExist(err)
+}
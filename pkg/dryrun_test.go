@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	var out bytes.Buffer
+	before := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	after := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	changed, err := writeUnifiedDiff(&out, "old", "new", before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -9,3 +9,4 @@
+ i
+ j
+ k
++l
+`
+	if !changed || out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	changed, err = writeUnifiedDiff(&out, "old", "new", before, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || out.Len() != 0 {
+		t.Errorf("expected no diff, got\n%s", out.String())
+	}
+}
+
+func TestPlanReconcileLeavesFilesUntouched(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	_, err := reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	mapFile := filepath.Join(monitorConfig.MapDir, "dyna-frontend-16443.exact.map")
+	beforeConfig, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beforeMap, err := os.ReadFile(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	result, err := planReconcile(client, buildModel(testClusters(), monitorConfig), &out, configFile, configFile)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) != 0 || out.Len() != 0 {
+		t.Errorf("expected nothing pending, got %v\n%s", result.Changes, out.String())
+	}
+
+	clusters := testClusters()
+	clusters[0].Ports[0].Targets = []string{"192.168.88.2", "192.168.88.4"}
+	clusters = clusters[:1]
+	result, err = planReconcile(client, buildModel(clusters, monitorConfig), &out, configFile, configFile)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) == 0 {
+		t.Fatal("expected pending changes")
+	}
+	for _, expected := range []string{
+		"--- " + configFile,
+		"-  server slot2 127.0.0.1:6443 disabled check verify none",
+		"+  server slot2 192.168.88.4:6443 check verify none",
+		"-backend b.example.com-6443",
+		"--- " + mapFile,
+		"-api.b.example.com b.example.com-6443",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in diff:\n%s", expected, out.String())
+		}
+	}
+
+	afterConfig, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterMap, err := os.ReadFile(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(beforeConfig, afterConfig) || !bytes.Equal(beforeMap, afterMap) {
+		t.Error("expected a dry run to leave the configuration and maps untouched")
+	}
+}
+
+func TestPlanBlankHostWritesNothing(t *testing.T) {
+	dir := t.TempDir()
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	monitorConfig.Client = data.ClientConfig{
+		ConfigurationFile: filepath.Join(dir, "haproxy", "haproxy.cfg"),
+		Haproxy:           "/bin/true",
+		TransactionDir:    filepath.Join(dir, "tx"),
+	}
+	monitorConfig.Haproxy = testHaproxyConfig()
+
+	output, cleanup, err := newPlanOutput(monitorConfig)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	defer cleanup()
+	var out bytes.Buffer
+	result, err := output.plan(buildModel(testClusters(), monitorConfig), &out)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) == 0 {
+		t.Fatal("expected pending changes")
+	}
+	for _, expected := range []string{
+		"--- /dev/null",
+		"+++ " + monitorConfig.Client.ConfigurationFile,
+		"+frontend dyna-stats",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in diff:\n%s", expected, out.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Dir(monitorConfig.Client.ConfigurationFile)); !os.IsNotExist(err) {
+		t.Errorf("expected a dry run not to create %s", monitorConfig.Client.ConfigurationFile)
+	}
+}
@@ -0,0 +1,442 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/haproxytech/client-native/runtime"
+	parser "github.com/haproxytech/config-parser"
+	"github.com/haproxytech/config-parser/common"
+	"github.com/haproxytech/config-parser/params"
+	"github.com/haproxytech/config-parser/types"
+	"github.com/haproxytech/models"
+	"github.com/pkg/errors"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultStatsURI is where the stats page is served unless uri is set.
+	DefaultStatsURI = "/stats"
+
+	// logGlobal is the log target address that stands for log global in the
+	// defaults section.
+	logGlobal = "global"
+
+	statsFrontendName = "dyna-stats"
+)
+
+// haproxyTimePattern matches an HAProxy time, in milliseconds without unit.
+var haproxyTimePattern = regexp.MustCompile(`^[0-9]+(us|ms|s|m|h|d)?$`)
+
+// defaultsTimeouts are the timeouts the defaults section can set.
+var defaultsTimeouts = map[string]bool{
+	"check":           true,
+	"client":          true,
+	"connect":         true,
+	"http-keep-alive": true,
+	"http-request":    true,
+	"queue":           true,
+	"server":          true,
+	"tunnel":          true,
+}
+
+// managedSocketParams are the stats socket options written from the
+// stats-socket block. Other options, such as user and group, are kept.
+var managedSocketParams = map[string]bool{
+	"mode":      true,
+	"level":     true,
+	"expose-fd": true,
+}
+
+func validateHaproxyConfig(config *data.HaproxyConfig) error {
+	if config == nil {
+		return nil
+	}
+	global := &config.Global
+	if global.Maxconn < 0 {
+		return errors.Errorf("invalid global maxconn %d", global.Maxconn)
+	}
+	if global.Nbthread < 0 {
+		return errors.Errorf("invalid global nbthread %d", global.Nbthread)
+	}
+	if len(global.StatsTimeout) > 0 && !haproxyTimePattern.MatchString(global.StatsTimeout) {
+		return errors.Errorf("invalid global stats-timeout %q", global.StatsTimeout)
+	}
+	switch global.StatsSocket.Level {
+	case "", "user", "operator", "admin":
+	default:
+		return errors.Errorf("unknown stats-socket level %s", global.StatsSocket.Level)
+	}
+	if _, err := strconv.ParseUint(global.StatsSocket.Mode, 8, 32); len(global.StatsSocket.Mode) > 0 && err != nil {
+		return errors.Errorf("invalid stats-socket mode %q", global.StatsSocket.Mode)
+	}
+	if err := validateLogTargets("global", global.Logs); err != nil {
+		return err
+	}
+
+	defaults := &config.Defaults
+	switch defaults.Mode {
+	case "", models.DefaultsModeTCP, models.DefaultsModeHTTP:
+	default:
+		return errors.Errorf("unknown defaults mode %s", defaults.Mode)
+	}
+	if defaults.Maxconn < 0 {
+		return errors.Errorf("invalid defaults maxconn %d", defaults.Maxconn)
+	}
+	if defaults.Retries < 0 {
+		return errors.Errorf("invalid defaults retries %d", defaults.Retries)
+	}
+	for name, value := range defaults.Timeouts {
+		if !defaultsTimeouts[name] {
+			return errors.Errorf("unknown defaults timeout %s", name)
+		}
+		if !haproxyTimePattern.MatchString(value) {
+			return errors.Errorf("invalid defaults timeout %s %q", name, value)
+		}
+	}
+	if err := validateLogTargets("defaults", defaults.Logs); err != nil {
+		return err
+	}
+	if strings.ContainsAny(defaults.LogFormat, "\n\"") {
+		return errors.Errorf("invalid defaults log-format %q", defaults.LogFormat)
+	}
+
+	stats := &config.Stats
+	if len(stats.Bind) > 0 {
+		_, portRaw, err := net.SplitHostPort(stats.Bind)
+		if err != nil {
+			return errors.Wrap(err, "invalid stats bind")
+		}
+		port, err := strconv.ParseInt(portRaw, 10, 64)
+		if err != nil || !validPort(port) {
+			return errors.Errorf("invalid stats bind port %s", portRaw)
+		}
+	}
+	if len(stats.URI) > 0 && (!strings.HasPrefix(stats.URI, "/") || strings.ContainsAny(stats.URI, " \t\n#")) {
+		return errors.Errorf("invalid stats uri %q", stats.URI)
+	}
+	if len(stats.Refresh) > 0 && !haproxyTimePattern.MatchString(stats.Refresh) {
+		return errors.Errorf("invalid stats refresh %q", stats.Refresh)
+	}
+	return nil
+}
+
+func validateLogTargets(section string, logs []data.LogTarget) error {
+	for _, target := range logs {
+		if target.Address == logGlobal {
+			if section != "defaults" {
+				return errors.Errorf("log global is only valid in defaults")
+			}
+			continue
+		}
+		if len(target.Address) == 0 {
+			return errors.Errorf("%s log target has no address", section)
+		}
+		if len(target.Facility) == 0 {
+			return errors.Errorf("%s log target %s has no facility", section, target.Address)
+		}
+	}
+	return nil
+}
+
+// settingsModel holds the global and defaults directives dyna-configure
+// manages, in the form the configuration parser reads and writes them.
+type settingsModel struct {
+	Global   []directive
+	Defaults []directive
+
+	// StatsSocket is the stats socket line to write, nil to leave the
+	// stats sockets alone.
+	StatsSocket *types.Socket
+}
+
+type directive struct {
+	Name string
+	Data common.ParserData
+}
+
+// buildSettings returns the directives set in config. statsSocket is the
+// path the runtime API is used on.
+func buildSettings(config *data.HaproxyConfig, statsSocket string) *settingsModel {
+	settings := &settingsModel{}
+	global := &config.Global
+	if global.Maxconn > 0 {
+		settings.Global = append(settings.Global, directive{"maxconn", &types.Int64C{Value: global.Maxconn}})
+	}
+	if global.Nbthread > 0 {
+		settings.Global = append(settings.Global, directive{"nbthread", &types.Int64C{Value: global.Nbthread}})
+	}
+	if len(global.StatsTimeout) > 0 {
+		settings.Global = append(settings.Global, directive{"stats timeout", &types.StringC{Value: global.StatsTimeout}})
+	}
+	if len(global.Logs) > 0 {
+		settings.Global = append(settings.Global, directive{"log", logLines(global.Logs)})
+	}
+	if global.StatsSocket.Enabled {
+		settings.StatsSocket = buildStatsSocket(&global.StatsSocket, statsSocket)
+	}
+
+	defaults := &config.Defaults
+	if len(defaults.Mode) > 0 {
+		settings.Defaults = append(settings.Defaults, directive{"mode", &types.StringC{Value: defaults.Mode}})
+	}
+	if defaults.Maxconn > 0 {
+		settings.Defaults = append(settings.Defaults, directive{"maxconn", &types.Int64C{Value: defaults.Maxconn}})
+	}
+	if defaults.Retries > 0 {
+		settings.Defaults = append(settings.Defaults, directive{"retries", &types.Int64C{Value: defaults.Retries}})
+	}
+	timeouts := []string{}
+	for name := range defaults.Timeouts {
+		timeouts = append(timeouts, name)
+	}
+	sort.Strings(timeouts)
+	for _, name := range timeouts {
+		settings.Defaults = append(settings.Defaults, directive{"timeout " + name, &types.SimpleTimeout{Value: defaults.Timeouts[name]}})
+	}
+	if len(defaults.Logs) > 0 {
+		settings.Defaults = append(settings.Defaults, directive{"log", logLines(defaults.Logs)})
+	}
+	if len(defaults.LogFormat) > 0 {
+		settings.Defaults = append(settings.Defaults, directive{"log-format", &types.StringC{Value: `"` + defaults.LogFormat + `"`}})
+	}
+	return settings
+}
+
+func logLines(targets []data.LogTarget) []types.Log {
+	lines := []types.Log{}
+	for _, target := range targets {
+		if target.Address == logGlobal {
+			lines = append(lines, types.Log{Global: true})
+			continue
+		}
+		lines = append(lines, types.Log{
+			Address:  target.Address,
+			Length:   target.Length,
+			Format:   target.Format,
+			Facility: target.Facility,
+			Level:    target.Level,
+			MinLevel: target.MinLevel,
+		})
+	}
+	return lines
+}
+
+// buildStatsSocket returns the stats socket line for path, admin level with
+// mode 660 and the listening sockets exposed unless configured otherwise.
+func buildStatsSocket(config *data.StatsSocketConfig, path string) *types.Socket {
+	if len(path) == 0 {
+		path = runtime.DefaultSocketPath
+	}
+	mode := config.Mode
+	if len(mode) == 0 {
+		mode = "660"
+	}
+	level := config.Level
+	if len(level) == 0 {
+		level = "admin"
+	}
+	options := []string{"mode", mode, "level", level}
+	if config.ExposeFdListeners == nil || *config.ExposeFdListeners {
+		options = append(options, "expose-fd", "listeners")
+	}
+	return &types.Socket{Path: path, Params: params.ParseBindOptions(options)}
+}
+
+// buildStatsFrontend returns the frontend serving the stats page. The stats
+// directives have no counterpart in models.Frontend and are written as is.
+func buildStatsFrontend(config *data.StatsConfig, ownership ownership) *frontendModel {
+	host, portRaw, _ := net.SplitHostPort(config.Bind)
+	if len(host) == 0 {
+		host = "0.0.0.0"
+	}
+	port, _ := strconv.ParseInt(portRaw, 10, 64)
+	uri := config.URI
+	if len(uri) == 0 {
+		uri = DefaultStatsURI
+	}
+	directives := []string{"stats enable", "stats uri " + uri}
+	if len(config.Refresh) > 0 {
+		directives = append(directives, "stats refresh "+config.Refresh)
+	}
+	name := ownership.name(statsFrontendName)
+	return &frontendModel{
+		Frontend: models.Frontend{
+			Mode: models.FrontendModeHTTP,
+			Name: name,
+		},
+		Binds: models.Binds{
+			{Name: name, Address: host, Port: &port},
+		},
+		Directives: directives,
+	}
+}
+
+// bootstrapConfiguration creates an empty configurationFile when there is
+// none, so the haproxy block can set up a blank host. client-native refuses
+// to load a missing file.
+func bootstrapConfiguration(configurationFile string) error {
+	_, err := os.Stat(configurationFile)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(configurationFile), 0755)
+	if err == nil {
+		err = os.WriteFile(configurationFile, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", configurationFile, err)
+	}
+	logrus.Infof("created empty %s", configurationFile)
+	return nil
+}
+
+// syncSettings sets the managed global and defaults directives through the
+// parser rather than client-native's PushGlobalConfiguration and
+// PushDefaultsConfiguration. Those rewrite every directive they model from a
+// single struct: they write nbthread 0 when it is unset, drop the user, group
+// and other options of the stats socket, write an empty
+// ssl-default-bind-options and turn option redispatch into option redispatch
+// 0. Putting all of that back after each push would touch more of the
+// administrator's lines than setting only the managed directives.
+func (r *reconciler) syncSettings(desired *settingsModel) error {
+	p, err := r.config.GetParser(r.transactionID)
+	if err != nil {
+		return err
+	}
+	err = r.syncDirectives(p, parser.Global, parser.GlobalSectionName, desired.Global)
+	if err != nil {
+		return err
+	}
+	if desired.StatsSocket != nil {
+		err = r.syncStatsSocket(p, desired.StatsSocket)
+		if err != nil {
+			return err
+		}
+	}
+	return r.syncDirectives(p, parser.Defaults, parser.DefaultSectionName, desired.Defaults)
+}
+
+func (r *reconciler) syncDirectives(p *parser.Parser, section parser.Section, name string, desired []directive) error {
+	for _, directive := range desired {
+		current, err := p.Get(section, name, directive.Name, false)
+		if err == nil && sameDirective(current, directive.Data) {
+			continue
+		}
+		err = p.Set(section, name, directive.Name, directive.Data)
+		if err != nil {
+			return fmt.Errorf("unable to set %s %s: %w", section, directive.Name, err)
+		}
+		r.record("set %s %s", section, directive.Name)
+	}
+	return nil
+}
+
+// sameDirective compares the values of current and desired, ignoring
+// comments an administrator left on the line.
+func sameDirective(current, desired common.ParserData) bool {
+	switch want := desired.(type) {
+	case *types.Int64C:
+		have, ok := current.(*types.Int64C)
+		return ok && have.Value == want.Value
+	case *types.StringC:
+		have, ok := current.(*types.StringC)
+		return ok && have.Value == want.Value
+	case *types.SimpleTimeout:
+		have, ok := current.(*types.SimpleTimeout)
+		return ok && have.Value == want.Value
+	case []types.Log:
+		have, ok := current.([]types.Log)
+		if !ok || len(have) != len(want) {
+			return false
+		}
+		for idx := range have {
+			line := have[idx]
+			line.Comment = ""
+			if line != want[idx] {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(current, desired)
+}
+
+// syncStatsSocket writes the managed options of the stats socket on
+// desired.Path, adding the socket if there is none. Sockets on other paths
+// are left alone.
+func (r *reconciler) syncStatsSocket(p *parser.Parser, desired *types.Socket) error {
+	sockets := []types.Socket{}
+	raw, err := p.Get(parser.Global, parser.GlobalSectionName, "stats socket", false)
+	if err == nil {
+		sockets = raw.([]types.Socket)
+	}
+	want := params.BindOptionsString(desired.Params)
+	for idx, socket := range sockets {
+		if socket.Path != desired.Path {
+			continue
+		}
+		options := []params.BindOption{}
+		managed := []params.BindOption{}
+		for _, option := range socket.Params {
+			if managedSocketParams[bindOptionName(option)] {
+				managed = append(managed, option)
+			} else {
+				options = append(options, option)
+			}
+		}
+		if params.BindOptionsString(managed) == want {
+			return nil
+		}
+		sockets[idx].Params = append(options, desired.Params...)
+		r.record("update stats socket %s", desired.Path)
+		return p.Set(parser.Global, parser.GlobalSectionName, "stats socket", sockets)
+	}
+	r.record("create stats socket %s", desired.Path)
+	return p.Set(parser.Global, parser.GlobalSectionName, "stats socket", append(sockets, *desired))
+}
+
+func bindOptionName(option params.BindOption) string {
+	fields := strings.Fields(option.String())
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// syncFrontendDirectives replaces the lines of frontend client-native does
+// not model with desired.
+func (r *reconciler) syncFrontendDirectives(frontend string, desired []string) error {
+	p, err := r.config.GetParser(r.transactionID)
+	if err != nil {
+		return err
+	}
+	current := []string{}
+	raw, err := p.Get(parser.Frontends, frontend, "", false)
+	if err == nil {
+		for _, line := range raw.([]types.UnProcessed) {
+			current = append(current, line.Value)
+		}
+	}
+	if len(current) == 0 && len(desired) == 0 || reflect.DeepEqual(current, desired) {
+		return nil
+	}
+	lines := []types.UnProcessed{}
+	for _, line := range desired {
+		lines = append(lines, types.UnProcessed{Value: line})
+	}
+	err = p.Set(parser.Frontends, frontend, "", lines)
+	if err != nil {
+		return fmt.Errorf("unable to set directives of frontend %s: %w", frontend, err)
+	}
+	r.record("update directives of frontend %s", frontend)
+	return nil
+}
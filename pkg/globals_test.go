@@ -0,0 +1,219 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func testHaproxyConfig() *data.HaproxyConfig {
+	return &data.HaproxyConfig{
+		Global: data.GlobalConfig{
+			Maxconn:      8000,
+			Nbthread:     4,
+			StatsSocket:  data.StatsSocketConfig{Enabled: true, Level: "operator"},
+			StatsTimeout: "30s",
+			Logs:         []data.LogTarget{{Address: "127.0.0.1", Facility: "local2"}},
+		},
+		Defaults: data.DefaultsConfig{
+			Mode:      "tcp",
+			Retries:   3,
+			Timeouts:  map[string]string{"connect": "5s", "client": "1m", "server": "1m"},
+			Logs:      []data.LogTarget{{Address: "global"}},
+			LogFormat: "%ci:%cp [%t] %ft %b/%s",
+		},
+		Stats: data.StatsConfig{Bind: "0.0.0.0:9000", Refresh: "10s"},
+	}
+}
+
+func TestReconcileSettings(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	monitorConfig.StatsSocket = "/var/run/haproxy.sock"
+	monitorConfig.Haproxy = testHaproxyConfig()
+
+	result, err := reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if !result.ReloadRequired {
+		t.Error("changing global settings should require a reload")
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"  daemon\n",
+		"  nbthread 4\n",
+		"  maxconn 8000\n",
+		"  stats socket /var/run/haproxy.sock mode 660 level operator expose-fd listeners\n",
+		"  stats timeout 30s\n",
+		"  log 127.0.0.1 local2\n",
+		"  log global\n",
+		`  log-format "%ci:%cp [%t] %ft %b/%s"` + "\n",
+		"  timeout connect 5s\n",
+		"  timeout client 1m\n",
+		"  retries 3\n",
+		"frontend dyna-stats",
+		"  bind 0.0.0.0:9000 name dyna-stats\n",
+		"  stats enable\n  stats uri /stats\n  stats refresh 10s\n",
+		"frontend stats",
+	} {
+		if !strings.Contains(string(raw), line) {
+			t.Errorf("expected %q in configuration:\n%s", line, raw)
+		}
+	}
+
+	result, err = reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) != 0 {
+		t.Errorf("expected no changes, got %v", result.Changes)
+	}
+
+	monitorConfig.Haproxy.Stats = data.StatsConfig{}
+	result, err = reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if strings.Join(result.Changes, "\n") != "delete frontend dyna-stats" {
+		t.Errorf("expected the stats frontend to be removed, got %v", result.Changes)
+	}
+}
+
+func TestStatsSocketKeepsUnmanagedOptions(t *testing.T) {
+	client, configFile := newTestClient(t)
+	if err := os.WriteFile(configFile, []byte("global\n  stats socket /run/haproxy.sock user haproxy group haproxy mode 600 level user\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Init(client.ClientParams); err != nil {
+		t.Fatal(err)
+	}
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	monitorConfig.StatsSocket = "/run/haproxy.sock"
+	monitorConfig.Haproxy = &data.HaproxyConfig{Global: data.GlobalConfig{StatsSocket: data.StatsSocketConfig{Enabled: true}}}
+
+	result, err := reconcile(client, buildModel(nil, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if strings.Join(result.Changes, "\n") != "update stats socket /run/haproxy.sock" {
+		t.Errorf("unexpected changes %v", result.Changes)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), "stats socket /run/haproxy.sock user haproxy group haproxy mode 660 level admin expose-fd listeners\n") {
+		t.Errorf("expected user and group to be kept:\n%s", raw)
+	}
+}
+
+func TestReconcileSettingsKeepsUnmanagedDirectives(t *testing.T) {
+	client, configFile := newTestClient(t)
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw = []byte(strings.Replace(string(raw), "  maxconn 4000\n", "  maxconn 4000\n  ssl-default-bind-options no-sslv3\n", 1))
+	raw = []byte(strings.Replace(string(raw), "defaults\n  mode tcp\n", "defaults\n  mode tcp\n  option redispatch\n", 1))
+	if err := os.WriteFile(configFile, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Init(client.ClientParams); err != nil {
+		t.Fatal(err)
+	}
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	monitorConfig.Haproxy = &data.HaproxyConfig{Global: data.GlobalConfig{Maxconn: 8000}, Defaults: data.DefaultsConfig{Retries: 3}}
+
+	_, err = reconcile(client, buildModel(nil, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err = os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"  maxconn 8000\n", "  retries 3\n", "  ssl-default-bind-options no-sslv3\n", "  option redispatch\n"} {
+		if !strings.Contains(string(raw), line) {
+			t.Errorf("expected %q in configuration:\n%s", line, raw)
+		}
+	}
+	if strings.Contains(string(raw), "nbthread") {
+		t.Errorf("expected nbthread to be left unset:\n%s", raw)
+	}
+}
+
+func TestBootstrapBlankHost(t *testing.T) {
+	dir := t.TempDir()
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	monitorConfig.Client = data.ClientConfig{
+		ConfigurationFile: filepath.Join(dir, "haproxy", "haproxy.cfg"),
+		Haproxy:           "/bin/true",
+		TransactionDir:    filepath.Join(dir, "tx"),
+	}
+	monitorConfig.Haproxy = testHaproxyConfig()
+
+	err := bootstrapConfiguration(monitorConfig.Client.ConfigurationFile)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	out, err := newOutput(monitorConfig)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	_, err = out.apply(buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(monitorConfig.Client.ConfigurationFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{"global", "defaults", "frontend dyna-stats", "frontend dyna-frontend-16443", "backend a.example.com-6443"} {
+		if !strings.Contains(string(raw), "\n"+section+" \n") {
+			t.Errorf("expected %s section in configuration:\n%s", section, raw)
+		}
+	}
+}
+
+func TestValidateHaproxyConfig(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		update func(*data.HaproxyConfig)
+		err    string
+	}{
+		{"valid", func(*data.HaproxyConfig) {}, ""},
+		{"timeout name", func(c *data.HaproxyConfig) { c.Defaults.Timeouts["idle"] = "1s" }, "unknown defaults timeout idle"},
+		{"timeout value", func(c *data.HaproxyConfig) { c.Defaults.Timeouts["connect"] = "5 s" }, "invalid defaults timeout connect"},
+		{"global log global", func(c *data.HaproxyConfig) { c.Global.Logs[0].Address = "global" }, "only valid in defaults"},
+		{"log facility", func(c *data.HaproxyConfig) { c.Global.Logs[0].Facility = "" }, "has no facility"},
+		{"socket level", func(c *data.HaproxyConfig) { c.Global.StatsSocket.Level = "root" }, "unknown stats-socket level"},
+		{"socket mode", func(c *data.HaproxyConfig) { c.Global.StatsSocket.Mode = "rw" }, "invalid stats-socket mode"},
+		{"stats bind", func(c *data.HaproxyConfig) { c.Stats.Bind = "0.0.0.0:0" }, "invalid stats bind port"},
+		{"stats uri", func(c *data.HaproxyConfig) { c.Stats.URI = "stats" }, "invalid stats uri"},
+	} {
+		config := testHaproxyConfig()
+		test.update(config)
+		err := validateHaproxyConfig(config)
+		if len(test.err) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	monitorConfig := &data.MonitorConfig{Haproxy: testHaproxyConfig(), Output: data.OutputConfig{Type: OutputTemplate}}
+	if err := validateOutput(&monitorConfig.Output, monitorConfig); err == nil {
+		t.Error("expected the haproxy block to be rejected for the template output")
+	}
+}
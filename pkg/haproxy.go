@@ -2,236 +2,450 @@ package pkg
 
 import (
 	"fmt"
+	"net/netip"
+	"os"
 	"strings"
 
-	"github.com/haproxytech/client-native/configuration"
+	"github.com/haproxytech/config-parser/params"
 	"github.com/haproxytech/models"
 	"github.com/rvanderp3/haproxy-dyna-configure/data"
 	"github.com/sirupsen/logrus"
 )
 
-func makeCleanModel(config *configuration.Client) error {
-	//config := client.Configuration
-	_, frontEnds, err := config.GetFrontends("")
-	if err != nil {
-		return fmt.Errorf("unable to get frontends: %w", err)
-	}
+const (
+	IpFamilyIPv4 = "ipv4"
+	IpFamilyIPv6 = "ipv6"
+	IpFamilyDual = "dual"
 
-	for _, frontEnd := range frontEnds {
-		version, err := config.GetVersion("")
-		if err != nil {
-			return fmt.Errorf("unable to get config version: %w", err)
-		}
-		if frontEnd.Name == "stats" {
-			continue
-		}
-		err = config.DeleteFrontend(frontEnd.Name, "", version)
-		if err != nil {
-			return fmt.Errorf("unable to delete frontend: %w", err)
+	// ProxyProtocolV1 and ProxyProtocolV2 select the PROXY protocol version
+	// servers send to the cluster ingress.
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// haproxyModel is the desired state of every frontend and backend managed by
+// dyna-configure.
+type haproxyModel struct {
+	Frontends []*frontendModel
+	Backends  []*backendModel
+	Ownership ownership
+
+	// Settings are the managed global and defaults directives, nil when
+	// the haproxy block is not set.
+	Settings *settingsModel
+
+	// Clusters are the discovered clusters the model was built from.
+	Clusters []data.Cluster
+
+	// Conflicts describes names routed by more than one cluster.
+	Conflicts []string
+}
+
+type frontendModel struct {
+	Frontend        models.Frontend
+	Binds           models.Binds
+	TCPRequestRules models.TCPRequestRules
+	SwitchingRules  models.BackendSwitchingRules
+	SNIMap          *mapFile
+
+	// Directives are written as is for the options models.Frontend cannot
+	// express.
+	Directives []string
+}
+
+type backendModel struct {
+	Backend models.Backend
+	Servers models.Servers
+
+	// ServerParams are added to every server line of the backend for the
+	// options models.Server cannot express.
+	ServerParams []params.ServerOption
+
+	// StickRules pin clients to a server through the backend stick table.
+	StickRules models.StickRules
+}
+
+func (m *haproxyModel) frontend(name string) *frontendModel {
+	for _, frontend := range m.Frontends {
+		if frontend.Frontend.Name == name {
+			return frontend
 		}
 	}
+	return nil
+}
 
-	_, backEnds, err := config.GetBackends("")
-	if err != nil {
-		return fmt.Errorf("unable to get backends: %w", err)
-	}
-	for _, backEnd := range backEnds {
-		version, err := config.GetVersion("")
-		if err != nil {
-			return fmt.Errorf("unable to get config version: %w", err)
-		}
-		err = config.DeleteBackend(backEnd.Name, "", version)
-		if err != nil {
-			return fmt.Errorf("unable to delete backend: %w", err)
+func (m *haproxyModel) backend(name string) *backendModel {
+	for _, backend := range m.Backends {
+		if backend.Backend.Name == name {
+			return backend
 		}
 	}
 	return nil
 }
 
-func createFrontend(config *configuration.Client, name string, port *data.MonitorPort) error {
-	logrus.Infof("creating frontend %s", name)
+// defaultBackend reports whether a managed frontend falls back to backend.
+// Such a backend may be owned by the operator and must survive the reconcile.
+func (m *haproxyModel) defaultBackend(backend string) bool {
+	for _, frontend := range m.Frontends {
+		if frontend.Frontend.DefaultBackend == backend {
+			return true
+		}
+	}
+	return false
+}
 
-	version, err := config.GetVersion("")
-	if err != nil {
-		return fmt.Errorf("unable to get config version: %w", err)
+// defaultListenPortOffset is added to the monitor port to derive the port a
+// frontend listens on when listen-port is not set.
+const defaultListenPortOffset = 10000
+
+// listenPort returns the port the frontend serving port listens on.
+func listenPort(port *data.MonitorPort) int64 {
+	if port.ListenPort > 0 {
+		return port.ListenPort
 	}
+	return port.Port + defaultListenPortOffset
+}
+
+func frontendName(port *data.MonitorPort) string {
+	return fmt.Sprintf("dyna-frontend-%d", listenPort(port))
+}
 
-	fe := models.Frontend{
-		Mode: models.FrontendModeTCP,
-		Name: name,
+// bindAddress returns the frontend bind address for the configured IP family.
+// Dual-stack frontends listen on [::] with v4v6 so IPv4 clients are accepted
+// on the same socket.
+func bindAddress(ipFamily string) (string, bool) {
+	switch ipFamily {
+	case IpFamilyIPv6:
+		return "[::]", false
+	case IpFamilyDual:
+		return "[::]", true
 	}
+	return "0.0.0.0", false
+}
 
-	_, _, err = config.GetFrontend(name, "")
-	if err == nil {
-		logrus.Infof("frontend %s already exists.", name)
-		return nil
+// buildBinds returns a bind for every bind-addresses entry of port, or a
+// single wildcard bind for the IP family if none are configured.
+func buildBinds(name string, port *data.MonitorPort, ipFamily string) models.Binds {
+	listen := listenPort(port)
+	wildcard, wildcardV4v6 := bindAddress(ipFamily)
+	addresses := port.BindAddresses
+	if len(addresses) == 0 {
+		addresses = []string{wildcard}
 	}
 
-	err = config.CreateFrontend(&fe, "", version)
-	if err != nil {
-		return fmt.Errorf("unable to create frontend: %w", err)
+	binds := models.Binds{}
+	for idx, address := range addresses {
+		address = serverAddress(address)
+		bind := &models.Bind{
+			Address:     address,
+			Port:        &listen,
+			Name:        name,
+			V4v6:        address == wildcard && wildcardV4v6,
+			Transparent: port.BindOptions.Transparent,
+			Process:     port.BindOptions.Process,
+			AcceptProxy: port.BindOptions.AcceptProxy,
+		}
+		if idx > 0 {
+			bind.Name = fmt.Sprintf("%s-%d", name, idx+1)
+		}
+		if port.BindOptions.TCPUserTimeout > 0 {
+			timeout := port.BindOptions.TCPUserTimeout
+			bind.TCPUserTimeout = &timeout
+		}
+		binds = append(binds, bind)
 	}
+	return binds
+}
 
-	version++
-	id := int64(0)
-	timeout := int64(5000)
-	tcpRule1 := models.TCPRequestRule{
-		ID:      &id,
-		Type:    models.TCPRequestRuleTypeInspectDelay,
-		Timeout: &timeout,
+// serverAddress brackets IPv6 literals so HAProxy does not read the last
+// group of the address as the port.
+func serverAddress(target string) string {
+	addr, err := netip.ParseAddr(target)
+	if err == nil && addr.Is6() {
+		return fmt.Sprintf("[%s]", addr.String())
 	}
-	err = config.CreateTCPRequestRule("frontend", name, &tcpRule1, "", version)
-	if err != nil {
-		return fmt.Errorf("unable to create TCP request rule 1: %w", err)
+	return target
+}
+
+// buildFrontend renders a frontend that routes on the SNI of each connection
+// through a map file, so clusters come and go by editing the map rather than
+// the rules of the frontend.
+func buildFrontend(name string, port *data.MonitorPort, monitorConfig *data.MonitorConfig) *frontendModel {
+	if port.Mode == PortModeHTTP {
+		return buildHTTPFrontend(name, port, monitorConfig)
 	}
+	timeout := int64(5000)
+	path := mapPath(monitorConfig.MapDir, name)
+
+	unmatched := fmt.Sprintf("{ req_ssl_hello_type 1 } !{ %s -m found } !{ %s -m found }", exactMapLookup(sniSample, path), suffixMapLookup(sniSample, path))
 
-	version++
-	tcpRule2 := models.TCPRequestRule{
+	rules := models.TCPRequestRules{
+		{
+			Type:    models.TCPRequestRuleTypeInspectDelay,
+			Timeout: &timeout,
+		},
+	}
+	rules = append(rules, unknownSNIRules(unknownSNITable(monitorConfig), unmatched)...)
+	if len(unknownSNIDefaultBackend(monitorConfig)) == 0 {
+		// Without a default backend an unmatched SNI would wait out the
+		// inspect delay before being reset, so reject it at once.
+		rules = append(rules, &models.TCPRequestRule{
+			Action:   models.TCPRequestRuleActionReject,
+			Cond:     models.TCPRequestRuleCondIf,
+			CondTest: unmatched,
+			Type:     models.TCPRequestRuleTypeContent,
+		})
+	}
+	rules = append(rules, &models.TCPRequestRule{
 		Action:   models.TCPRequestRuleActionAccept,
 		Cond:     models.TCPRequestRuleCondIf,
-		ID:       &id,
 		CondTest: "{ req_ssl_hello_type 1 }",
 		Type:     models.TCPRequestRuleTypeContent,
-	}
-	err = config.CreateTCPRequestRule("frontend", name, &tcpRule2, "", version)
-	if err != nil {
-		return fmt.Errorf("unable to create TCP request rule 2: %w", err)
+	})
+	for idx := range rules {
+		id := int64(idx)
+		rules[idx].ID = &id
 	}
 
-	version++
-	containerPort := port.Port + 10000
-	bind := models.Bind{
-		Address: "0.0.0.0",
-		Port:    &containerPort,
-		Name:    name,
+	return &frontendModel{
+		Frontend: models.Frontend{
+			Mode:           models.FrontendModeTCP,
+			Name:           name,
+			DefaultBackend: unknownSNIDefaultBackend(monitorConfig),
+		},
+		Binds:           buildBinds(name, port, monitorConfig.IpFamily),
+		TCPRequestRules: rules,
+		SwitchingRules:  mapSwitchingRules(sniSample, path),
+		SNIMap:          &mapFile{Path: path},
 	}
-	err = config.CreateBind(name, &bind, "", version)
-	if err != nil {
-		return fmt.Errorf("unable to create bind: %w", err)
+}
+
+// buildMapEntry returns the map entry routing SNI or host names of port for
+// baseDomain to backendName: a suffix entry for path-prefix ports and an
+// exact name for path-match ports.
+func buildMapEntry(baseDomain string, backendName string, port *data.MonitorPort) *mapEntry {
+	if len(port.PathPrefix) > 0 {
+		pathPrefix := strings.TrimPrefix(port.PathPrefix, "*")
+		return &mapEntry{
+			Key:     strings.ToLower(pathPrefix + "." + baseDomain),
+			Backend: backendName,
+		}
+	} else if len(port.PathMatch) > 0 {
+		return &mapEntry{
+			Key:     strings.ToLower(port.PathMatch + "." + baseDomain),
+			Backend: backendName,
+		}
 	}
 	return nil
 }
 
-func createBackendSwitchingRule(config *configuration.Client, baseDomain string, frontendName string, backendName string, port *data.MonitorPort) error {
-	logrus.Infof("creating backend switching rule %s", backendName)
+// buildBackend renders a backend with a fixed pool of server slots, in the
+// style of server-template. Targets fill the first slots and the remaining
+// slots are parked in maintenance so later churn can be applied through the
+// runtime API. The pool grows in multiples of serverSlots.
+func buildBackend(name string, port *data.MonitorPort, serverSlots int) *backendModel {
+	backend := &backendModel{
+		Backend: models.Backend{
+			Mode: models.BackendModeTCP,
+			Name: name,
+		},
+		Servers: models.Servers{},
+	}
+	if port.Mode == PortModeHTTP {
+		backend.Backend.Mode = models.BackendModeHTTP
+	}
 
-	version, err := config.GetVersion("")
-	if err != nil {
-		return err
+	if serverSlots <= 0 {
+		serverSlots = DefaultServerSlots
+	}
+	slots := serverSlots
+	for slots < len(port.Targets) {
+		slots += serverSlots
+	}
+	for idx := 0; idx < slots; idx++ {
+		server := &models.Server{
+			Name:   fmt.Sprintf("%s%d", serverSlotPrefix, idx+1),
+			Check:  models.ServerCheckEnabled,
+			Verify: models.ServerVerifyNone,
+		}
+		switch port.SendProxy {
+		case ProxyProtocolV1:
+			server.SendProxy = models.ServerSendProxyEnabled
+		case ProxyProtocolV2:
+			server.SendProxyV2 = models.ServerSendProxyV2Enabled
+		}
+		if idx < len(port.Targets) {
+			fillSlot(server, serverAddress(port.Targets[idx]), port.Port)
+			server.Weight = serverWeight(port, port.Targets[idx])
+		} else {
+			emptySlot(server, port.Port)
+			server.Weight = optionalInt64(port.Weight)
+		}
+		backend.Servers = append(backend.Servers, server)
 	}
-	id := int64(0)
+	return backend
+}
 
-	var rule models.BackendSwitchingRule
+// buildModel renders the discovered clusters into the desired HAProxy model.
+func buildModel(clusters []data.Cluster, monitorConfig *data.MonitorConfig) *haproxyModel {
+	model := &haproxyModel{Ownership: newOwnership(&monitorConfig.Ownership), Clusters: clusters}
+	for _, cluster := range clusters {
+		for _, monitorPort := range cluster.Ports {
+			if len(monitorPort.Targets) == 0 {
+				continue
+			}
+			name := model.Ownership.name(fmt.Sprintf("%s-%d", cluster.BaseDomain, monitorPort.Port))
+			frontendName := model.Ownership.name(frontendName(&monitorPort))
+			entry := buildMapEntry(cluster.BaseDomain, name, &monitorPort)
+			if entry == nil {
+				logrus.Warnf("port %s has no path-prefix or path-match, skipping %s", monitorPort.Name, name)
+				continue
+			}
 
-	if len(port.PathPrefix) > 0 {
-		pathPrefix := port.PathPrefix
-		if strings.HasPrefix(pathPrefix, "*") {
-			pathPrefix = pathPrefix[1:]
+			backend := buildBackend(name, &monitorPort, monitorConfig.ServerSlots)
+			applyHealthCheck(backend, cluster.BaseDomain, &monitorPort)
+			applyBalance(backend, &monitorPort, monitorConfig.IpFamily)
+			model.Backends = append(model.Backends, backend)
+			frontend := model.frontend(frontendName)
+			if frontend == nil {
+				frontend = buildFrontend(frontendName, &monitorPort, monitorConfig)
+				model.Frontends = append(model.Frontends, frontend)
+			}
+			if conflict := frontend.SNIMap.add(*entry); len(conflict) > 0 {
+				model.Conflicts = append(model.Conflicts, conflict)
+			}
 		}
-		rule = models.BackendSwitchingRule{
-			Cond:     "if",
-			ID:       &id,
-			Name:     backendName,
-			CondTest: fmt.Sprintf("{ req.ssl_sni -m end %s%s }", pathPrefix, baseDomain),
+	}
+	for _, frontend := range model.Frontends {
+		frontend.SNIMap.sortEntries()
+		model.Conflicts = append(model.Conflicts, frontend.SNIMap.conflicts()...)
+	}
+	for _, frontend := range model.Frontends {
+		if frontend.Frontend.Mode == models.FrontendModeTCP {
+			model.Backends = append(model.Backends, buildUnknownSNIBackend(monitorConfig))
+			break
 		}
-	} else if len(port.PathMatch) > 0 {
-		rule = models.BackendSwitchingRule{
-			Cond:     "if",
-			ID:       &id,
-			Name:     backendName,
-			CondTest: fmt.Sprintf("{ req.ssl_sni -i %s%s }", port.PathMatch, baseDomain),
+	}
+	if haproxy := monitorConfig.Haproxy; haproxy != nil {
+		model.Settings = buildSettings(haproxy, monitorConfig.StatsSocket)
+		if len(haproxy.Stats.Bind) > 0 {
+			model.Frontends = append(model.Frontends, buildStatsFrontend(&haproxy.Stats, model.Ownership))
 		}
 	}
+	return model
+}
 
-	err = config.CreateBackendSwitchingRule(frontendName, &rule, "", version)
+// ApplyConfiguration reconciles every output target with the discovered
+// clusters it accepts and reports whether any HAProxy must still be
+// reloaded. A target that fails does not keep the others from being updated.
+func ApplyConfiguration(monitorConfig *data.MonitorConfigSpec) (bool, error) {
+	targets, err := resolveTargets(&monitorConfig.MonitorConfig)
 	if err != nil {
-		return err
+		return false, err
 	}
-
-	return nil
+	reloadRequired := false
+	failed := []string{}
+	for _, target := range targets {
+		required, err := applyTarget(target, target.clusters(monitorConfig.MonitorConfig.MonitorRanges))
+		reloadRequired = reloadRequired || required
+		if err != nil {
+			if len(targets) == 1 {
+				return reloadRequired, err
+			}
+			target.log().Errorf("unable to apply configuration: %s", err)
+			failed = append(failed, target.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return reloadRequired, fmt.Errorf("unable to apply targets %s", strings.Join(failed, ", "))
+	}
+	return reloadRequired, nil
 }
 
-func createBackend(config *configuration.Client, name string, port *data.MonitorPort) error {
-	logrus.Infof("creating backend %s", name)
-
-	version, err := config.GetVersion("")
+// applyTarget reconciles the HAProxy of target with clusters and reports
+// whether it must still be reloaded. Changes that only move targets between
+// existing server slots or edit SNI map entries are applied through the
+// runtime API instead, and other changes trigger the configured reload
+// method, if any.
+func applyTarget(target *outputTarget, clusters []data.Cluster) (bool, error) {
+	monitorConfig := target.MonitorConfig
+	log := target.log()
+	if monitorConfig.Haproxy != nil {
+		err := bootstrapConfiguration(clientParams(&monitorConfig.Client).ConfigurationFile)
+		if err != nil {
+			return false, err
+		}
+	}
+	out, err := newOutput(monitorConfig)
 	if err != nil {
-		return fmt.Errorf("unable to get config version: %w", err)
+		return false, err
+	}
+
+	previous, err := os.ReadFile(out.configFile())
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("unable to read configuration: %w", err)
 	}
-	backend := &models.Backend{
-		Mode: models.BackendModeTCP,
-		Name: name,
+
+	model := buildModel(clusters, monitorConfig)
+	for _, conflict := range model.Conflicts {
+		log.Warnf("conflicting routes: %s", conflict)
 	}
-	err = config.CreateBackend(backend, "", version)
+	result, err := out.apply(model)
 	if err != nil {
-		return fmt.Errorf("unable to create backend: %w", err)
+		return false, fmt.Errorf("unable to reconcile configuration: %w", err)
+	}
+	if len(result.Changes) == 0 {
+		log.Info("no changes")
+		return false, nil
+	}
+	for _, change := range result.Changes {
+		log.Infof("applied: %s", change)
+	}
+	if len(out.configFile()) == 0 {
+		// The Data Plane API validated and reloaded HAProxy on commit.
+		return false, nil
 	}
 
-	for _, target := range port.Targets {
-		port := port.Port
-		server := &models.Server{
-			Address: target,
-			Port:    &port,
-			Name:    fmt.Sprintf("%s-%d", target, port),
-			Check:   models.ServerCheckEnabled,
-			Verify:  models.ServerVerifyNone,
-		}
-		version, err = config.GetVersion("")
-		if err != nil {
-			return fmt.Errorf("unable to get config version: %w", err)
+	reload := &monitorConfig.Reload
+	if reload.Validate {
+		haproxy := reload.Haproxy
+		if len(haproxy) == 0 {
+			haproxy = clientParams(&monitorConfig.Client).Haproxy
 		}
-		err = config.CreateServer(name, server, "", version)
+		err = validateConfiguration(haproxy, out.checkFiles()...)
 		if err != nil {
-			return fmt.Errorf("unable to create server: %w", err)
+			restoreErr := restoreConfiguration(out.configFile(), previous)
+			restoreMapFiles(result.MapBackups)
+			if restoreErr != nil {
+				return false, fmt.Errorf("unable to restore configuration after %s: %w", err, restoreErr)
+			}
+			log.Warnf("restored previous configuration")
+			return false, err
 		}
 	}
-	return nil
-}
-
-func ApplyConfiguration(monitorConfig *data.MonitorConfigSpec) error {
 
-	clientParams := configuration.ClientParams{
-		ConfigurationFile:      configuration.DefaultConfigurationFile,
-		Haproxy:                configuration.DefaultHaproxy,
-		UseValidation:          configuration.DefaultUseValidation,
-		PersistentTransactions: false,
-		TransactionDir:         "/etc/haproxy/tx",
-		MasterWorker:           false,
+	statsSocket := monitorConfig.StatsSocket
+	if !result.ReloadRequired {
+		runtimeClient, err := newRuntimeClient(statsSocket)
+		if err == nil {
+			err = applyServerUpdates(runtimeClient, result.ServerUpdates)
+		}
+		if err == nil {
+			err = applyMapUpdates(runtimeClient, result.MapUpdates)
+		}
+		if err == nil {
+			log.Infof("updated %d servers and %d map entries through the runtime API", len(result.ServerUpdates), len(result.MapUpdates))
+			return false, nil
+		}
+		log.Warnf("unable to update servers through the runtime API, a reload is required: %s", err)
 	}
 
-	client := &configuration.Client{}
-	err := client.Init(clientParams)
-
-	if err != nil {
-		return err
+	if len(reload.Method) == 0 {
+		return true, nil
 	}
-
-	//client.
-	//client.
-	err = makeCleanModel(client)
+	err = reloadHaproxy(reload, statsSocket)
 	if err != nil {
-		return err
-	}
-	for _, monitorRange := range monitorConfig.MonitorConfig.MonitorRanges {
-		for _, monitorPort := range monitorRange.MonitorPorts {
-			if len(monitorPort.Targets) == 0 || len(monitorRange.BaseDomain) == 0 {
-				continue
-			}
-			name := fmt.Sprintf("%s-%d", monitorRange.BaseDomain, monitorPort.Port)
-			frontendName := fmt.Sprintf("dyna-frontend-%d", monitorPort.Port)
-			err := createBackend(client, name, &monitorPort)
-			if err != nil {
-				return fmt.Errorf("unable to create backend: %w", err)
-			}
-			err = createFrontend(client, frontendName, &monitorPort)
-			if err != nil {
-				return fmt.Errorf("unable to create frontend: %w", err)
-			}
-			err = createBackendSwitchingRule(client, monitorRange.BaseDomain, frontendName, name, &monitorPort)
-			if err != nil {
-				return fmt.Errorf("unable to create backend switching rules: %w", err)
-			}
-		}
+		return true, err
 	}
-	return nil
+	return false, nil
 }
@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func TestBuildBinds(t *testing.T) {
+	port := &data.MonitorPort{Port: 443}
+	binds := buildBinds(frontendName(port), port, IpFamilyDual)
+	if len(binds) != 1 || binds[0].Address != "[::]" || *binds[0].Port != 10443 || !binds[0].V4v6 {
+		t.Errorf("unexpected default bind %+v", binds[0])
+	}
+
+	port = &data.MonitorPort{
+		Port:          443,
+		ListenPort:    443,
+		BindAddresses: []string{"192.168.10.1", "fd00:10::1"},
+		BindOptions:   data.BindOptions{Transparent: true, TCPUserTimeout: 30000},
+	}
+	name := frontendName(port)
+	if name != "dyna-frontend-443" {
+		t.Errorf("expected frontend named after the listen port, got %s", name)
+	}
+	binds = buildBinds(name, port, IpFamilyDual)
+	expected := []struct {
+		name    string
+		address string
+	}{
+		{"dyna-frontend-443", "192.168.10.1"},
+		{"dyna-frontend-443-2", "[fd00:10::1]"},
+	}
+	if len(binds) != len(expected) {
+		t.Fatalf("expected %d binds, got %d", len(expected), len(binds))
+	}
+	for idx, bind := range binds {
+		if bind.Name != expected[idx].name || bind.Address != expected[idx].address || *bind.Port != 443 {
+			t.Errorf("expected %v, got %s %s:%d", expected[idx], bind.Name, bind.Address, *bind.Port)
+		}
+		if bind.V4v6 || !bind.Transparent || bind.TCPUserTimeout == nil || *bind.TCPUserTimeout != 30000 {
+			t.Errorf("unexpected options on %+v", bind)
+		}
+	}
+}
+
+func TestReconcileProxyProtocol(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+
+	clusters := testClusters()
+	clusters[0].Ports[0].SendProxy = ProxyProtocolV2
+	clusters[0].Ports[0].BindOptions.AcceptProxy = true
+	clusters[0].Ports[1].SendProxy = ProxyProtocolV1
+	_, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"bind 0.0.0.0:16443 name dyna-frontend-16443 accept-proxy",
+		"server slot1 192.168.88.2:6443 check verify none send-proxy-v2",
+		"server slot1 192.168.88.3:443 check verify none send-proxy",
+		"server slot2 127.0.0.1:443 disabled check verify none send-proxy",
+	} {
+		if !strings.Contains(string(raw), expected) {
+			t.Errorf("expected %q in configuration:\n%s", expected, raw)
+		}
+	}
+
+	clusters[0].Ports[1].Targets = []string{"192.168.88.3", "192.168.88.5"}
+	result, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if result.ReloadRequired {
+		t.Errorf("filling a slot that sends PROXY should not require a reload, got %v", result.Changes)
+	}
+}
+
+func TestApplyTargetRestoresMapsOnFailedValidation(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	monitorConfig.Client = data.ClientConfig{
+		ConfigurationFile: configFile,
+		Haproxy:           "/bin/true",
+		TransactionDir:    client.TransactionDir,
+	}
+	target := &outputTarget{MonitorConfig: monitorConfig}
+	if _, err := applyTarget(target, testClusters()); err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	mapFile := filepath.Join(monitorConfig.MapDir, "dyna-frontend-16443.exact.map")
+	before, err := os.ReadFile(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configBefore, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	monitorConfig.Reload = data.ReloadConfig{Validate: true, Haproxy: "/bin/false"}
+	_, err = applyTarget(target, testClusters()[:1])
+	if err == nil {
+		t.Fatal("expected the failed validation to fail the run")
+	}
+	after, err := os.ReadFile(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("expected the map to be restored with the configuration, got:\n%s", after)
+	}
+	configAfter, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(configAfter) != string(configBefore) {
+		t.Errorf("expected the configuration to be restored:\n%s", configAfter)
+	}
+}
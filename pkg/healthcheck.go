@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"strings"
+
+	"github.com/haproxytech/config-parser/params"
+	"github.com/haproxytech/models"
+	"github.com/pkg/errors"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+const (
+	HealthCheckTCP      = "tcp"
+	HealthCheckSSLHello = "ssl-hello"
+	HealthCheckHTTPS    = "https"
+
+	// DefaultHealthCheckPath is requested by https checks unless path is set.
+	DefaultHealthCheckPath = "/readyz"
+)
+
+// managedServerParams are the server options dyna-configure sets on the raw
+// server lines because models.Server has no field for them.
+var managedServerParams = map[string]bool{
+	"check-ssl": true,
+	"check-sni": true,
+}
+
+func validateHealthCheck(port *data.MonitorPort) error {
+	switch port.HealthCheck.Type {
+	case "", HealthCheckTCP, HealthCheckSSLHello, HealthCheckHTTPS:
+	default:
+		return errors.Errorf("unknown health-check type %s for port %s", port.HealthCheck.Type, port.Name)
+	}
+	if port.HealthCheck.Port < 0 || port.HealthCheck.Port > 65535 {
+		return errors.Errorf("invalid health-check port %d for port %s", port.HealthCheck.Port, port.Name)
+	}
+	if port.HealthCheck.Inter < 0 || port.HealthCheck.Fall < 0 || port.HealthCheck.Rise < 0 {
+		return errors.Errorf("health-check timers for port %s must not be negative", port.Name)
+	}
+	return nil
+}
+
+// checkSNI returns the name sent in the TLS handshake of https checks: the
+// configured sni, or the name routed to the backend with any wildcard
+// stripped.
+func checkSNI(baseDomain string, port *data.MonitorPort) string {
+	if len(port.HealthCheck.SNI) > 0 {
+		return port.HealthCheck.SNI
+	}
+	entry := buildMapEntry(baseDomain, "", port)
+	if entry == nil {
+		return baseDomain
+	}
+	return strings.TrimPrefix(entry.Key, ".")
+}
+
+func optionalInt64(value int64) *int64 {
+	if value <= 0 {
+		return nil
+	}
+	return &value
+}
+
+// applyHealthCheck adds the check directives configured for port to backend.
+// Without a health-check type, servers keep the plain connect check.
+func applyHealthCheck(backend *backendModel, baseDomain string, port *data.MonitorPort) {
+	healthCheck := &port.HealthCheck
+	switch healthCheck.Type {
+	case HealthCheckTCP:
+		backend.Backend.AdvCheck = models.BackendAdvCheckTCPCheck
+	case HealthCheckSSLHello:
+		backend.Backend.AdvCheck = models.BackendAdvCheckSslHelloChk
+	case HealthCheckHTTPS:
+		path := healthCheck.Path
+		if len(path) == 0 {
+			path = DefaultHealthCheckPath
+		}
+		backend.Backend.Httpchk = &models.Httpchk{
+			Method: "GET",
+			URI:    path,
+		}
+		backend.ServerParams = []params.ServerOption{
+			&params.ServerOptionWord{Name: "check-ssl"},
+			&params.ServerOptionValue{Name: "check-sni", Value: checkSNI(baseDomain, port)},
+		}
+	}
+
+	if healthCheck.Inter > 0 || healthCheck.Fall > 0 || healthCheck.Rise > 0 || healthCheck.Port > 0 {
+		backend.Backend.DefaultServer = &models.DefaultServer{
+			Inter: optionalInt64(healthCheck.Inter),
+			Fall:  optionalInt64(healthCheck.Fall),
+			Rise:  optionalInt64(healthCheck.Rise),
+			Port:  optionalInt64(healthCheck.Port),
+		}
+	}
+}
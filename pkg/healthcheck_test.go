@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func TestReconcileHealthChecks(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+
+	clusters := testClusters()
+	clusters[0].Ports[0].HealthCheck = data.HealthCheck{Type: HealthCheckHTTPS, Inter: 2000, Fall: 3, Rise: 2}
+	clusters[0].Ports[1].HealthCheck = data.HealthCheck{Type: HealthCheckSSLHello, Port: 1936}
+	_, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"option httpchk GET /readyz",
+		"default-server fall 3 inter 2000 rise 2",
+		"server slot1 192.168.88.2:6443 check verify none check-ssl check-sni api.a.example.com",
+		"option ssl-hello-chk",
+		"default-server port 1936",
+	} {
+		if !strings.Contains(string(raw), expected) {
+			t.Errorf("expected %q in configuration:\n%s", expected, raw)
+		}
+	}
+
+	result, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) != 0 {
+		t.Errorf("expected no changes, got %v", result.Changes)
+	}
+
+	clusters[0].Ports[0].Targets = []string{"192.168.88.2", "192.168.88.4"}
+	result, err = reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if result.ReloadRequired {
+		t.Errorf("filling a slot of a checked backend should not require a reload, got %v", result.Changes)
+	}
+	raw, err = os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), "server slot2 192.168.88.4:6443 check verify none check-ssl check-sni api.a.example.com") {
+		t.Errorf("expected check options on the filled slot:\n%s", raw)
+	}
+}
+
+func TestCheckSNI(t *testing.T) {
+	port := &data.MonitorPort{PathPrefix: "*.apps"}
+	if sni := checkSNI("a.example.com", port); sni != "apps.a.example.com" {
+		t.Errorf("expected apps.a.example.com, got %s", sni)
+	}
+	port.HealthCheck.SNI = "console-openshift-console.apps.a.example.com"
+	if sni := checkSNI("a.example.com", port); sni != port.HealthCheck.SNI {
+		t.Errorf("expected the configured sni, got %s", sni)
+	}
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"github.com/haproxytech/models"
+	"github.com/pkg/errors"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+const (
+	// PortModeTLS routes connections on their SNI, the default.
+	PortModeTLS = "tls"
+	// PortModeHTTP routes plain HTTP requests on their Host header.
+	PortModeHTTP = "http"
+)
+
+// validatePortModes checks the mode of every port of monitorRange and that
+// each domain-from names a port of the same range that discovers its own
+// base domain.
+func validatePortModes(monitorRange *data.MonitorRange) error {
+	for _, monitorPort := range monitorRange.MonitorPorts {
+		switch monitorPort.Mode {
+		case "", PortModeTLS, PortModeHTTP:
+		default:
+			return errors.Errorf("unknown mode %s for port %s", monitorPort.Mode, monitorPort.Name)
+		}
+		if monitorPort.DomainFrom == 0 {
+			if monitorPort.Mode == PortModeHTTP {
+				return errors.Errorf("http port %s requires domain-from", monitorPort.Name)
+			}
+			continue
+		}
+		linked := rangePort(monitorRange, monitorPort.DomainFrom)
+		if linked == nil || linked.DomainFrom != 0 || linked.Mode == PortModeHTTP {
+			return errors.Errorf("domain-from %d of port %s is not a TLS port of the same range", monitorPort.DomainFrom, monitorPort.Name)
+		}
+	}
+	return nil
+}
+
+func rangePort(monitorRange *data.MonitorRange, port int64) *data.MonitorPort {
+	for idx := range monitorRange.MonitorPorts {
+		if monitorRange.MonitorPorts[idx].Port == port {
+			return &monitorRange.MonitorPorts[idx]
+		}
+	}
+	return nil
+}
+
+// targetDomain returns the base domain of target on monitorPort. Ports with
+// domain-from have no certificate to read it from and take the domain the
+// same target presented on the linked port.
+func targetDomain(monitorRange *data.MonitorRange, monitorPort *data.MonitorPort, target string) string {
+	if monitorPort.DomainFrom == 0 {
+		return monitorPort.TargetDomains[target]
+	}
+	linked := rangePort(monitorRange, monitorPort.DomainFrom)
+	if linked == nil {
+		return ""
+	}
+	return linked.TargetDomains[target]
+}
+
+// buildHTTPFrontend renders an HTTP mode frontend that routes requests on
+// their Host header through a map file. Requests for unknown hosts get the
+// 503 HAProxy answers when no backend matches, since the unknown-sni
+// backends speak TLS.
+func buildHTTPFrontend(name string, port *data.MonitorPort, monitorConfig *data.MonitorConfig) *frontendModel {
+	path := mapPath(monitorConfig.MapDir, name)
+	return &frontendModel{
+		Frontend: models.Frontend{
+			Mode: models.FrontendModeHTTP,
+			Name: name,
+		},
+		Binds:          buildBinds(name, port, monitorConfig.IpFamily),
+		SwitchingRules: mapSwitchingRules(hostSample, path),
+		SNIMap:         &mapFile{Path: path},
+	}
+}
@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func TestGroupClustersLinksHTTPPort(t *testing.T) {
+	monitorRange := data.MonitorRange{
+		MonitorPorts: []data.MonitorPort{
+			{
+				Port:    443,
+				Targets: []string{"192.168.88.4", "192.168.88.5"},
+				TargetDomains: map[string]string{
+					"192.168.88.4": "a.example.com",
+					"192.168.88.5": "b.example.com",
+				},
+			},
+			{
+				Port:          80,
+				Mode:          PortModeHTTP,
+				DomainFrom:    443,
+				Targets:       []string{"192.168.88.4", "192.168.88.5", "192.168.88.6"},
+				TargetDomains: map[string]string{},
+			},
+		},
+	}
+
+	clusters := groupClusters(&monitorRange)
+	expected := []data.Cluster{
+		{
+			BaseDomain: "a.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 443, Targets: []string{"192.168.88.4"}},
+				{Port: 80, Mode: PortModeHTTP, DomainFrom: 443, Targets: []string{"192.168.88.4"}},
+			},
+		},
+		{
+			BaseDomain: "b.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 443, Targets: []string{"192.168.88.5"}},
+				{Port: 80, Mode: PortModeHTTP, DomainFrom: 443, Targets: []string{"192.168.88.5"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(clusters, expected) {
+		t.Errorf("expected %+v, got %+v", expected, clusters)
+	}
+}
+
+func TestValidatePortModes(t *testing.T) {
+	valid := data.MonitorRange{
+		MonitorPorts: []data.MonitorPort{
+			{Port: 443},
+			{Port: 80, Mode: PortModeHTTP, DomainFrom: 443},
+		},
+	}
+	if err := validatePortModes(&valid); err != nil {
+		t.Errorf("failed: %s", err)
+	}
+	invalid := []data.MonitorRange{
+		{MonitorPorts: []data.MonitorPort{{Port: 80, Mode: "udp"}}},
+		{MonitorPorts: []data.MonitorPort{{Port: 80, Mode: PortModeHTTP}}},
+		{MonitorPorts: []data.MonitorPort{{Port: 80, Mode: PortModeHTTP, DomainFrom: 443}}},
+		{MonitorPorts: []data.MonitorPort{{Port: 80, Mode: PortModeHTTP, DomainFrom: 8080}, {Port: 8080, Mode: PortModeHTTP, DomainFrom: 443}}},
+	}
+	for _, monitorRange := range invalid {
+		if err := validatePortModes(&monitorRange); err == nil {
+			t.Errorf("%+v: expected an error", monitorRange)
+		}
+	}
+}
+
+func TestReconcileHTTPFrontend(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+
+	clusters := testClusters()
+	clusters[0].Ports = append(clusters[0].Ports, data.MonitorPort{
+		Port:       80,
+		PathPrefix: "*.apps",
+		Mode:       PortModeHTTP,
+		DomainFrom: 443,
+		Targets:    []string{"192.168.88.3"},
+	})
+	_, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(monitorConfig.MapDir, "dyna-frontend-10080.map")
+	for _, expected := range []string{
+		"frontend dyna-frontend-10080",
+		"mode http # " + DefaultOwnershipMarker,
+		"use_backend %[req.hdr(host),lower,field(1,:),map_end(" + path + ")]",
+		"server slot1 192.168.88.3:80 check verify none",
+	} {
+		if !strings.Contains(string(raw), expected) {
+			t.Errorf("expected %q in configuration:\n%s", expected, raw)
+		}
+	}
+	hostMap, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(hostMap) != ".apps.a.example.com a.example.com-80\n" {
+		t.Errorf("unexpected map:\n%s", hostMap)
+	}
+
+	result, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) != 0 {
+		t.Errorf("expected no changes, got %v", result.Changes)
+	}
+}
@@ -0,0 +1,278 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/haproxytech/client-native/runtime"
+	"github.com/haproxytech/models"
+)
+
+const (
+	// DefaultMapDir is where SNI map files are kept unless map-dir is set.
+	DefaultMapDir = "/etc/haproxy/maps"
+)
+
+var (
+	runtimeErrorPattern = regexp.MustCompile(`^\[[0-3]\]:`)
+	mapRulePattern      = regexp.MustCompile(`map_(?:end|str)\(([^),]+)`)
+)
+
+const (
+	// sniSample and hostSample are the names looked up in the maps of TCP
+	// and HTTP mode frontends.
+	sniSample  = "req.ssl_sni,lower"
+	hostSample = "req.hdr(host),lower,field(1,:)"
+)
+
+// mapEntry routes SNI names ending in Key to Backend.
+type mapEntry struct {
+	Key     string
+	Backend string
+}
+
+// mapFile is an SNI-to-backend map kept next to haproxy.cfg and looked up by
+// the use_backend rules of a frontend. It is written as two files, see files.
+type mapFile struct {
+	Path    string
+	Entries []mapEntry
+}
+
+// mapUpdate is a change to a single map entry that can be applied through the
+// runtime API without reloading HAProxy. An empty Backend removes the key.
+type mapUpdate struct {
+	Path    string
+	Key     string
+	Backend string
+	Exists  bool
+}
+
+func mapPath(mapDir string, frontend string) string {
+	if len(mapDir) == 0 {
+		mapDir = DefaultMapDir
+	}
+	return filepath.Join(mapDir, frontend+".map")
+}
+
+// exactMapPath returns the map holding the exact names of the frontend whose
+// suffix entries are kept in path.
+func exactMapPath(path string) string {
+	return strings.TrimSuffix(path, ".map") + ".exact.map"
+}
+
+// exactMapLookup and suffixMapLookup return the expressions looking up sample
+// in the maps of path. Exact names are matched with map_str, as map_end would
+// also route every name merely ending in one.
+func exactMapLookup(sample string, path string) string {
+	return fmt.Sprintf("%s,map_str(%s)", sample, exactMapPath(path))
+}
+
+func suffixMapLookup(sample string, path string) string {
+	return fmt.Sprintf("%s,map_end(%s)", sample, path)
+}
+
+// mapSwitchingRules returns the use_backend rules that look sample up among
+// the exact names first and then among the suffixes of path.
+func mapSwitchingRules(sample string, path string) models.BackendSwitchingRules {
+	exactID, suffixID := int64(0), int64(1)
+	return models.BackendSwitchingRules{
+		{
+			ID:       &exactID,
+			Name:     "%[" + exactMapLookup(sample, path) + "]",
+			Cond:     models.BackendSwitchingRuleCondIf,
+			CondTest: fmt.Sprintf("{ %s -m found }", exactMapLookup(sample, path)),
+		},
+		{
+			ID:   &suffixID,
+			Name: "%[" + suffixMapLookup(sample, path) + "]",
+		},
+	}
+}
+
+// files splits m into the map of exact names, at exactMapPath(Path), and the
+// map of suffix entries at Path.
+func (m *mapFile) files() []*mapFile {
+	exact := &mapFile{Path: exactMapPath(m.Path), Entries: []mapEntry{}}
+	suffixes := &mapFile{Path: m.Path, Entries: []mapEntry{}}
+	for _, entry := range m.Entries {
+		if exactEntry(entry.Key) {
+			exact.Entries = append(exact.Entries, entry)
+		} else {
+			suffixes.Entries = append(suffixes.Entries, entry)
+		}
+	}
+	return []*mapFile{exact, suffixes}
+}
+
+func (m *mapFile) lookup(key string) (string, bool) {
+	for _, entry := range m.Entries {
+		if entry.Key == key {
+			return entry.Backend, true
+		}
+	}
+	return "", false
+}
+
+// add appends entry unless its key is already routed, and returns a conflict
+// if the key was routed to another backend.
+func (m *mapFile) add(entry mapEntry) string {
+	backend, exists := m.lookup(entry.Key)
+	if !exists {
+		m.Entries = append(m.Entries, entry)
+		return ""
+	}
+	if backend != entry.Backend {
+		return fmt.Sprintf("%s is routed to %s, ignoring %s", entry.Key, backend, entry.Backend)
+	}
+	return ""
+}
+
+// exactEntry reports whether key names a single host. Suffix keys of
+// path-prefix ports start with a dot.
+func exactEntry(key string) bool {
+	return !strings.HasPrefix(key, ".")
+}
+
+// sortEntries orders the entries most specific first: exact names, then
+// suffixes from longest to shortest, ties by name. map_end returns the first
+// entry that matches, so a cluster whose domain ends in the domain of another
+// cluster is not shadowed by it, and the file is identical across runs.
+func (m *mapFile) sortEntries() {
+	sort.SliceStable(m.Entries, func(i, j int) bool {
+		a, b := m.Entries[i].Key, m.Entries[j].Key
+		if exactEntry(a) != exactEntry(b) {
+			return exactEntry(a)
+		}
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+}
+
+// conflicts reports every pair of entries where a name routed to one backend
+// also matches the suffix routed to another.
+func (m *mapFile) conflicts() []string {
+	conflicts := []string{}
+	for _, entry := range m.Entries {
+		for _, other := range m.Entries {
+			if entry.Key == other.Key || entry.Backend == other.Backend || exactEntry(other.Key) {
+				continue
+			}
+			if strings.HasSuffix(entry.Key, other.Key) {
+				conflicts = append(conflicts, fmt.Sprintf("%s (%s) overlaps %s (%s)", entry.Key, entry.Backend, other.Key, other.Backend))
+			}
+		}
+	}
+	return conflicts
+}
+
+// shadowingEntry returns the key of an entry in m that already matches the
+// key added by update. HAProxy appends entries added at runtime, so such an
+// entry would keep matching first until the map is reloaded from the file.
+func (m *mapFile) shadowingEntry(update mapUpdate) string {
+	if m == nil || update.Exists || len(update.Backend) == 0 {
+		return ""
+	}
+	for _, entry := range m.Entries {
+		if !exactEntry(entry.Key) && entry.Key != update.Key && strings.HasSuffix(update.Key, entry.Key) {
+			return entry.Key
+		}
+	}
+	return ""
+}
+
+func (m *mapFile) render() []byte {
+	var buf bytes.Buffer
+	for _, entry := range m.Entries {
+		fmt.Fprintf(&buf, "%s %s\n", entry.Key, entry.Backend)
+	}
+	return buf.Bytes()
+}
+
+// readMapFile returns the entries of the map at path, or nil if the map does
+// not exist yet.
+func readMapFile(path string) (*mapFile, []byte, error) {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read map %s: %w", path, err)
+	}
+	current := &mapFile{Path: path}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		current.Entries = append(current.Entries, mapEntry{Key: fields[0], Backend: fields[1]})
+	}
+	return current, raw, nil
+}
+
+// diffMap returns the runtime updates that turn current into desired.
+func diffMap(current *mapFile, desired *mapFile) []mapUpdate {
+	updates := []mapUpdate{}
+	if current == nil {
+		current = &mapFile{Path: desired.Path}
+	}
+	for _, entry := range desired.Entries {
+		backend, exists := current.lookup(entry.Key)
+		if exists && backend == entry.Backend {
+			continue
+		}
+		updates = append(updates, mapUpdate{Path: desired.Path, Key: entry.Key, Backend: entry.Backend, Exists: exists})
+	}
+	for _, entry := range current.Entries {
+		if _, ok := desired.lookup(entry.Key); !ok {
+			updates = append(updates, mapUpdate{Path: desired.Path, Key: entry.Key, Exists: true})
+		}
+	}
+	return updates
+}
+
+func (u mapUpdate) String() string {
+	switch {
+	case len(u.Backend) == 0:
+		return fmt.Sprintf("del map %s %s", u.Path, u.Key)
+	case u.Exists:
+		return fmt.Sprintf("set map %s %s %s", u.Path, u.Key, u.Backend)
+	}
+	return fmt.Sprintf("add map %s %s %s", u.Path, u.Key, u.Backend)
+}
+
+// executeRuntime runs command on every process behind client and fails if
+// any of them reports an error.
+func executeRuntime(client *runtime.Client, command string) error {
+	responses, err := client.ExecuteRaw(command)
+	if err != nil {
+		return err
+	}
+	for _, response := range responses {
+		response = strings.TrimSpace(response)
+		if runtimeErrorPattern.MatchString(response) {
+			return fmt.Errorf("%s: %s", command, response)
+		}
+	}
+	return nil
+}
+
+// applyMapUpdates updates the in-memory copy of each map HAProxy loaded. The
+// files on disk were already rewritten by the reconcile.
+func applyMapUpdates(client *runtime.Client, updates []mapUpdate) error {
+	for _, update := range updates {
+		err := executeRuntime(client, update.String())
+		if err != nil {
+			return fmt.Errorf("unable to update map: %w", err)
+		}
+	}
+	return nil
+}
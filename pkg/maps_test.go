@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func TestDiffMap(t *testing.T) {
+	current := &mapFile{
+		Path: "/etc/haproxy/maps/dyna-frontend-10443.map",
+		Entries: []mapEntry{
+			{Key: ".apps.a.example.com", Backend: "a.example.com-443"},
+			{Key: ".apps.b.example.com", Backend: "b.example.com-443"},
+		},
+	}
+	desired := &mapFile{
+		Path: current.Path,
+		Entries: []mapEntry{
+			{Key: ".apps.a.example.com", Backend: "a.example.com-443"},
+			{Key: ".apps.b.example.com", Backend: "b.example.com-8443"},
+			{Key: ".apps.c.example.com", Backend: "c.example.com-443"},
+		},
+	}
+	updates := diffMap(current, desired)
+	commands := []string{}
+	for _, update := range updates {
+		commands = append(commands, update.String())
+	}
+	expected := []string{
+		"set map /etc/haproxy/maps/dyna-frontend-10443.map .apps.b.example.com b.example.com-8443",
+		"add map /etc/haproxy/maps/dyna-frontend-10443.map .apps.c.example.com c.example.com-443",
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %v, got %v", expected, commands)
+	}
+
+	updates = diffMap(desired, current)
+	if len(updates) != 2 || updates[1].String() != "del map /etc/haproxy/maps/dyna-frontend-10443.map .apps.c.example.com" {
+		t.Errorf("expected c.example.com to be removed, got %v", updates)
+	}
+}
+
+func TestApplyMapUpdatesReportsErrors(t *testing.T) {
+	socket := newFakeStatsSocket(t, func(command string) string {
+		if command == "add map /missing.map api.a.example.com a.example.com-6443" {
+			return "[3]: Unknown map identifier.\n"
+		}
+		return "\n"
+	})
+	client, err := newRuntimeClient(socket.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = applyMapUpdates(client, []mapUpdate{
+		{Path: "/etc/haproxy/maps/dyna-frontend-16443.map", Key: "api.a.example.com", Backend: "a.example.com-6443"},
+	})
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	err = applyMapUpdates(client, []mapUpdate{
+		{Path: "/missing.map", Key: "api.a.example.com", Backend: "a.example.com-6443"},
+	})
+	if err == nil {
+		t.Error("expected the runtime error to be reported")
+	}
+}
+
+func TestSortEntriesMostSpecificFirst(t *testing.T) {
+	sniMap := &mapFile{}
+	for _, entry := range []mapEntry{
+		{Key: ".apps.ci.example.com", Backend: "ci.example.com-443"},
+		{Key: "api.ci.example.com", Backend: "ci.example.com-6443"},
+		{Key: ".apps.a.apps.ci.example.com", Backend: "a.apps.ci.example.com-443"},
+		{Key: ".apps.b.example.com", Backend: "b.example.com-443"},
+		{Key: "api.a.apps.ci.example.com", Backend: "a.apps.ci.example.com-6443"},
+	} {
+		if conflict := sniMap.add(entry); len(conflict) > 0 {
+			t.Errorf("unexpected conflict %s", conflict)
+		}
+	}
+	if conflict := sniMap.add(mapEntry{Key: ".apps.b.example.com", Backend: "c.example.com-443"}); len(conflict) == 0 {
+		t.Error("expected a conflict for a name routed twice")
+	}
+	sniMap.sortEntries()
+	expected := "api.a.apps.ci.example.com a.apps.ci.example.com-6443\n" +
+		"api.ci.example.com ci.example.com-6443\n" +
+		".apps.a.apps.ci.example.com a.apps.ci.example.com-443\n" +
+		".apps.ci.example.com ci.example.com-443\n" +
+		".apps.b.example.com b.example.com-443\n"
+	if string(sniMap.render()) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, sniMap.render())
+	}
+
+	expectedConflicts := []string{
+		"api.a.apps.ci.example.com (a.apps.ci.example.com-6443) overlaps .apps.ci.example.com (ci.example.com-443)",
+		".apps.a.apps.ci.example.com (a.apps.ci.example.com-443) overlaps .apps.ci.example.com (ci.example.com-443)",
+	}
+	if conflicts := sniMap.conflicts(); !reflect.DeepEqual(conflicts, expectedConflicts) {
+		t.Errorf("expected %v, got %v", expectedConflicts, conflicts)
+	}
+}
+
+func TestReconcileShadowedMapEntryRequiresReload(t *testing.T) {
+	client, _ := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	clusters := []data.Cluster{
+		{
+			BaseDomain: "ci.example.com",
+			Ports:      []data.MonitorPort{{Port: 443, PathPrefix: "*.apps", Targets: []string{"192.168.88.3"}}},
+		},
+	}
+	_, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+
+	clusters = append(clusters, data.Cluster{
+		BaseDomain: "a.apps.ci.example.com",
+		Ports:      []data.MonitorPort{{Port: 443, PathPrefix: "*.apps", Targets: []string{"192.168.88.4"}}},
+	})
+	model := buildModel(clusters, monitorConfig)
+	if len(model.Conflicts) != 1 {
+		t.Errorf("expected the overlapping domains to be reported, got %v", model.Conflicts)
+	}
+	result, err := reconcile(client, model)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if !result.ReloadRequired || len(result.MapUpdates) != 0 {
+		t.Errorf("expected a reload since a runtime add would be shadowed, got %v", result.Changes)
+	}
+	raw, err := os.ReadFile(filepath.Join(monitorConfig.MapDir, "dyna-frontend-10443.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != ".apps.a.apps.ci.example.com a.apps.ci.example.com-443\n.apps.ci.example.com ci.example.com-443\n" {
+		t.Errorf("unexpected map:\n%s", raw)
+	}
+}
+
+// routeSNI resolves name the way the use_backend rules of mapSwitchingRules
+// do: an exact name from the first file, then the first suffix of the second.
+func routeSNI(files []*mapFile, name string) string {
+	if backend, ok := files[0].lookup(name); ok {
+		return backend
+	}
+	for _, entry := range files[1].Entries {
+		if strings.HasSuffix(name, entry.Key) {
+			return entry.Backend
+		}
+	}
+	return ""
+}
+
+func TestExactEntriesDoNotMatchLookAlikes(t *testing.T) {
+	sniMap := &mapFile{
+		Path: "/etc/haproxy/maps/dyna-frontend-16443.map",
+		Entries: []mapEntry{
+			{Key: ".apps.a.example.com", Backend: "a.example.com-443"},
+			{Key: "api.a.example.com", Backend: "a.example.com-6443"},
+		},
+	}
+	sniMap.sortEntries()
+	files := sniMap.files()
+	if files[0].Path != "/etc/haproxy/maps/dyna-frontend-16443.exact.map" || len(files[0].Entries) != 1 || len(files[1].Entries) != 1 {
+		t.Fatalf("expected exact and suffix entries in separate files, got %+v %+v", files[0], files[1])
+	}
+	rules := mapSwitchingRules(sniSample, sniMap.Path)
+	if rules[0].Name != "%[req.ssl_sni,lower,map_str("+files[0].Path+")]" || rules[1].Name != "%[req.ssl_sni,lower,map_end("+files[1].Path+")]" {
+		t.Errorf("expected exact names looked up with map_str first, got %s and %s", rules[0].Name, rules[1].Name)
+	}
+
+	for name, expected := range map[string]string{
+		"api.a.example.com":          "a.example.com-6443",
+		"xapi.a.example.com":         "",
+		"foo.api.a.example.com":      "",
+		"console.apps.a.example.com": "a.example.com-443",
+	} {
+		if backend := routeSNI(files, name); backend != expected {
+			t.Errorf("expected %s to route to %q, got %q", name, expected, backend)
+		}
+	}
+}
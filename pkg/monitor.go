@@ -2,18 +2,15 @@ package pkg
 
 import (
 	"context"
-	"crypto/tls"
-	"fmt"
 	"net"
-	"net/http"
 	"net/netip"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-yaml/yaml"
-	"github.com/netdata/go.d.plugin/pkg/iprange"
 	"github.com/pkg/errors"
 	"github.com/rvanderp3/haproxy-dyna-configure/data"
 	"github.com/sirupsen/logrus"
@@ -22,9 +19,9 @@ import (
 var monitorConfig data.MonitorConfigSpec
 var mu sync.Mutex
 
-const (
-	MonitorConfigurationFile = "monitor-config.yaml"
-)
+// MonitorConfigurationFile is read by Initialize and may be changed from the
+// command line.
+var MonitorConfigurationFile = "monitor-config.yaml"
 
 func Initialize(ctx context.Context) error {
 	configRaw, err := os.ReadFile(MonitorConfigurationFile)
@@ -35,8 +32,63 @@ func Initialize(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	Overrides.apply(&monitorConfig.MonitorConfig)
+
+	switch monitorConfig.MonitorConfig.IpFamily {
+	case "", IpFamilyIPv4, IpFamilyIPv6, IpFamilyDual:
+	default:
+		return errors.Errorf("unknown ip-family %s", monitorConfig.MonitorConfig.IpFamily)
+	}
+	err = validateReloadConfig(&monitorConfig.MonitorConfig.Reload)
+	if err != nil {
+		return err
+	}
+	err = validateUnknownSNIConfig(&monitorConfig.MonitorConfig.UnknownSNI)
+	if err != nil {
+		return err
+	}
+	err = validateOwnership(&monitorConfig.MonitorConfig.Ownership)
+	if err != nil {
+		return err
+	}
+	err = validateHaproxyConfig(monitorConfig.MonitorConfig.Haproxy)
+	if err != nil {
+		return err
+	}
+	err = validateOutput(&monitorConfig.MonitorConfig.Output, &monitorConfig.MonitorConfig)
 	if err != nil {
-		return nil
+		return err
+	}
+	for _, monitorRange := range monitorConfig.MonitorConfig.MonitorRanges {
+		if err := validatePortModes(&monitorRange); err != nil {
+			return err
+		}
+		for _, monitorPort := range monitorRange.MonitorPorts {
+			switch monitorPort.Probe {
+			case "", ProbeHTTP, ProbeTLS, ProbeTCP:
+			default:
+				return errors.Errorf("unknown probe %s for port %s", monitorPort.Probe, monitorPort.Name)
+			}
+			if err := validateHealthCheck(&monitorPort); err != nil {
+				return err
+			}
+			if err := validateBalance(&monitorPort); err != nil {
+				return err
+			}
+			switch monitorPort.SendProxy {
+			case "", ProxyProtocolV1, ProxyProtocolV2:
+			default:
+				return errors.Errorf("unknown send-proxy version %s for port %s", monitorPort.SendProxy, monitorPort.Name)
+			}
+			if monitorPort.ListenPort < 0 || monitorPort.ListenPort > 65535 {
+				return errors.Errorf("invalid listen-port %d for port %s", monitorPort.ListenPort, monitorPort.Name)
+			}
+			for _, address := range monitorPort.BindAddresses {
+				if _, err := netip.ParseAddr(address); err != nil {
+					return errors.Wrapf(err, "invalid bind address for port %s", monitorPort.Name)
+				}
+			}
+		}
 	}
 
 	if len(monitorConfig.MonitorConfig.SubnetsJson) > 0 {
@@ -46,94 +98,83 @@ func Initialize(ctx context.Context) error {
 		}
 		monitorConfig.MonitorConfig.MonitorRanges = append(monitorConfig.MonitorConfig.MonitorRanges, nativeSubnetRanges...)
 	}
-	return nil
+	return validateTargets(&monitorConfig.MonitorConfig)
 }
 
 func CheckRanges(ctx context.Context) (*data.MonitorConfigSpec, error) {
-	var wg sync.WaitGroup
-	const maxThreads = 10
-	var activeThreads = 0
+	if monitorConfig.MonitorConfig.ScanTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(monitorConfig.MonitorConfig.ScanTimeout)*time.Millisecond)
+		defer cancel()
+	}
 
+	scheduler := newProbeScheduler(monitorConfig.MonitorConfig.MaxConcurrency)
+	var wg sync.WaitGroup
 	for idx := range monitorConfig.MonitorConfig.MonitorRanges {
-		if activeThreads >= maxThreads {
-			wg.Wait()
-			activeThreads = 0
-		}
 		wg.Add(1)
-		activeThreads++
-		go CheckRange(ctx, &wg, &monitorConfig.MonitorConfig.MonitorRanges[idx])
+		go CheckRange(ctx, &wg, scheduler, &monitorConfig.MonitorConfig.MonitorRanges[idx])
 	}
 	wg.Wait()
-	return &monitorConfig, nil
-}
+	scheduler.wait()
 
-func CheckPort(ctx context.Context, wg *sync.WaitGroup, monitorPort *data.MonitorPort, monitorRange *data.MonitorRange, ip string) {
-	defer wg.Done()
-	client := http.Client{
-		Timeout: time.Duration(monitorConfig.MonitorConfig.CheckTimeout) * time.Millisecond,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "scan did not complete")
 	}
+	return &monitorConfig, nil
+}
 
+func CheckPort(ctx context.Context, monitorPort *data.MonitorPort, ip string) {
 	protocol := monitorPort.Protocol
 	if len(protocol) == 0 {
 		protocol = "https"
+		if monitorPort.Mode == PortModeHTTP {
+			protocol = "http"
+		}
 		mu.Lock()
 		monitorPort.Protocol = protocol
 		mu.Unlock()
 	}
-	url := fmt.Sprintf("%s://%s:%d", protocol, ip, monitorPort.Port)
-	logrus.Debugf("checking URL %s", url)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	resp, err := client.Do(req)
+	address := net.JoinHostPort(ip, strconv.FormatInt(monitorPort.Port, 10))
+	timeout := time.Duration(monitorConfig.MonitorConfig.CheckTimeout) * time.Millisecond
+	certs, err := probeTarget(ctx, monitorPort.Probe, protocol, address, timeout)
 	if err != nil {
 		return
 	}
 	mu.Lock()
 	monitorPort.Targets = append(monitorPort.Targets, ip)
 	mu.Unlock()
-	if resp.TLS != nil {
-		for _, cert := range resp.TLS.PeerCertificates {
-			for _, dnsname := range cert.DNSNames {
-				var prefix string
-				mu.Lock()
-				if len(monitorPort.PathPrefix) > 0 {
-					prefix = monitorPort.PathPrefix
-				} else if len(monitorPort.PathMatch) > 0 {
-					prefix = monitorPort.PathMatch
+	for _, cert := range certs {
+		for _, dnsname := range cert.DNSNames {
+			var prefix string
+			mu.Lock()
+			if len(monitorPort.PathPrefix) > 0 {
+				prefix = monitorPort.PathPrefix
+			} else if len(monitorPort.PathMatch) > 0 {
+				prefix = monitorPort.PathMatch
+			}
+			mu.Unlock()
+			if strings.HasPrefix(dnsname, prefix) {
+				splits := strings.SplitAfter(dnsname, prefix)
+				if len(splits) < 2 {
+					continue
 				}
-				mu.Unlock()
-				if strings.HasPrefix(dnsname, prefix) {
-					splits := strings.SplitAfter(dnsname, prefix)
-					if len(splits) < 2 {
-						continue
-					}
 
-					mu.Lock()
-					monitorRange.BaseDomain = splits[1]
-					logrus.Infof("found base domain %s", monitorRange.BaseDomain)
-					mu.Unlock()
+				baseDomain := strings.ToLower(strings.TrimPrefix(splits[1], "."))
+				if len(baseDomain) == 0 {
+					continue
 				}
+				mu.Lock()
+				monitorPort.TargetDomains[ip] = baseDomain
+				logrus.Infof("found base domain %s at %s", baseDomain, address)
+				mu.Unlock()
 			}
 		}
 	}
-
 }
 
-func CheckRange(ctx context.Context, cWaitGroup *sync.WaitGroup, monitorRange *data.MonitorRange) {
+func CheckRange(ctx context.Context, cWaitGroup *sync.WaitGroup, scheduler *probeScheduler, monitorRange *data.MonitorRange) {
 	defer cWaitGroup.Done()
-	parseRange, err := iprange.ParseRange(fmt.Sprintf("%s-%s", monitorRange.IpAddressStart, monitorRange.IpAddressEnd))
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-
-	ip, err := netip.ParseAddr(monitorRange.IpAddressStart)
+	addrs, err := expandRange(monitorRange)
 	if err != nil {
 		logrus.Error(err)
 		return
@@ -141,21 +182,20 @@ func CheckRange(ctx context.Context, cWaitGroup *sync.WaitGroup, monitorRange *d
 
 	for idx := range monitorRange.MonitorPorts {
 		monitorRange.MonitorPorts[idx].Targets = []string{}
+		monitorRange.MonitorPorts[idx].TargetDomains = map[string]string{}
 	}
-	var wg sync.WaitGroup
-	const maxThreads = 25
-	var activeThreads = 0
-	for parseRange.Contains(net.ParseIP(ip.String())) {
+	rangeSlots := newRangeSlots(monitorRange.MaxConcurrency)
+	for _, ip := range addrs {
 		for idx := range monitorRange.MonitorPorts {
-			if activeThreads >= maxThreads {
-				wg.Wait()
-				activeThreads = 0
+			monitorPort := &monitorRange.MonitorPorts[idx]
+			target := ip.String()
+			scheduled := scheduler.schedule(ctx, rangeSlots, func() {
+				CheckPort(ctx, monitorPort, target)
+			})
+			if !scheduled {
+				logrus.Warnf("stopped scanning range %s at %s: %s", describeRange(monitorRange), target, ctx.Err())
+				return
 			}
-			wg.Add(1)
-			activeThreads++
-			go CheckPort(ctx, &wg, &monitorRange.MonitorPorts[idx], monitorRange, ip.String())
 		}
-		ip = ip.Next()
 	}
-	wg.Wait()
 }
@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"io"
+	"net/url"
+
+	"github.com/haproxytech/client-native/configuration"
+	"github.com/pkg/errors"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+const (
+	// OutputClientNative edits haproxy.cfg in place through client-native.
+	OutputClientNative = "client-native"
+	// OutputTemplate renders a managed include file from a text/template.
+	OutputTemplate = "template"
+	// OutputDataplane pushes the configuration to a HAProxy Data Plane API.
+	OutputDataplane = "dataplane"
+)
+
+// output writes the desired haproxyModel where HAProxy reads it from.
+type output interface {
+	// apply brings the configuration in line with desired. An empty
+	// Changes means nothing was written.
+	apply(desired *haproxyModel) (*reconcileResult, error)
+
+	// plan writes the unified diff of every file apply would change to out
+	// without touching them.
+	plan(desired *haproxyModel, out io.Writer) (*reconcileResult, error)
+
+	// configFile is the file apply rewrites, restored when the new
+	// configuration fails validation. Outputs that validate remotely
+	// return an empty name.
+	configFile() string
+
+	// checkFiles are passed to haproxy -c, in order, to validate the
+	// configuration.
+	checkFiles() []string
+}
+
+func validateOutput(output *data.OutputConfig, monitorConfig *data.MonitorConfig) error {
+	if monitorConfig.Haproxy != nil && len(output.Type) > 0 && output.Type != OutputClientNative {
+		return errors.Errorf("the haproxy block requires the %s output", OutputClientNative)
+	}
+	switch output.Type {
+	case "", OutputClientNative:
+	case OutputTemplate:
+		_, err := loadTemplate(output.Template)
+		return err
+	case OutputDataplane:
+		if _, err := url.ParseRequestURI(output.URL); err != nil || len(output.URL) == 0 {
+			return errors.Errorf("output type %s requires a valid url", output.Type)
+		}
+		// Sections pushed over the API carry no marker comment.
+		if len(monitorConfig.Ownership.Prefix) == 0 {
+			return errors.Errorf("output type %s requires an ownership prefix", output.Type)
+		}
+		for _, monitorRange := range monitorConfig.MonitorRanges {
+			for _, monitorPort := range monitorRange.MonitorPorts {
+				if monitorPort.HealthCheck.Type == HealthCheckHTTPS {
+					return errors.Errorf("health-check type %s of port %s cannot be set over the Data Plane API", HealthCheckHTTPS, monitorPort.Name)
+				}
+			}
+		}
+	default:
+		return errors.Errorf("unknown output type %s", output.Type)
+	}
+	return nil
+}
+
+// newOutput returns the output selected by the output block of monitorConfig.
+func newOutput(monitorConfig *data.MonitorConfig) (output, error) {
+	params := clientParams(&monitorConfig.Client)
+	switch monitorConfig.Output.Type {
+	case OutputTemplate:
+		return newTemplateOutput(&monitorConfig.Output, params.ConfigurationFile)
+	case OutputDataplane:
+		return &dataplaneOutput{client: newDataplaneClient(&monitorConfig.Output)}, nil
+	}
+	client := &configuration.Client{}
+	err := client.Init(params)
+	if err != nil {
+		return nil, err
+	}
+	return &clientNativeOutput{client: client}, nil
+}
+
+// clientNativeOutput reconciles haproxy.cfg through a configuration.Client.
+type clientNativeOutput struct {
+	client *configuration.Client
+	// bootstrapFile is set when a dry run plans the haproxy.cfg the haproxy
+	// block would create. The client then works on an empty stand-in.
+	bootstrapFile string
+}
+
+func (o *clientNativeOutput) apply(desired *haproxyModel) (*reconcileResult, error) {
+	return reconcile(o.client, desired)
+}
+
+func (o *clientNativeOutput) plan(desired *haproxyModel, out io.Writer) (*reconcileResult, error) {
+	if len(o.bootstrapFile) > 0 {
+		return planReconcile(o.client, desired, out, "/dev/null", o.bootstrapFile)
+	}
+	return planReconcile(o.client, desired, out, o.client.ConfigurationFile, o.client.ConfigurationFile)
+}
+
+func (o *clientNativeOutput) configFile() string {
+	return o.client.ConfigurationFile
+}
+
+func (o *clientNativeOutput) checkFiles() []string {
+	return []string{o.client.ConfigurationFile}
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	parser "github.com/haproxytech/config-parser"
+	"github.com/haproxytech/config-parser/types"
+	"github.com/pkg/errors"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultOwnershipMarker is the comment written on the mode line of
+	// every managed section unless marker is set.
+	DefaultOwnershipMarker = "managed by haproxy-dyna-configure"
+
+	// legacyFrontendPrefix starts the name of every frontend written by
+	// releases that did not mark their sections.
+	legacyFrontendPrefix = "dyna-frontend-"
+)
+
+// ownership tells the sections dyna-configure manages apart from the ones an
+// administrator added to haproxy.cfg by hand.
+type ownership struct {
+	Prefix string
+	Marker string
+}
+
+func newOwnership(config *data.OwnershipConfig) ownership {
+	return ownership{Prefix: config.Prefix, Marker: config.Marker}
+}
+
+func validateOwnership(config *data.OwnershipConfig) error {
+	if strings.ContainsAny(config.Prefix, " \t\n#") {
+		return errors.Errorf("invalid ownership prefix %q", config.Prefix)
+	}
+	if strings.ContainsAny(config.Marker, "\n#") {
+		return errors.Errorf("invalid ownership marker %q", config.Marker)
+	}
+	return nil
+}
+
+// name returns the name of a managed section, starting with the prefix.
+func (o ownership) name(name string) string {
+	if strings.HasPrefix(name, o.Prefix) {
+		return name
+	}
+	return o.Prefix + name
+}
+
+func (o ownership) marker() string {
+	if len(o.Marker) > 0 {
+		return o.Marker
+	}
+	return DefaultOwnershipMarker
+}
+
+func sectionKind(section parser.Section) string {
+	if section == parser.Frontends {
+		return "frontend"
+	}
+	return "backend"
+}
+
+// owned reports whether the section named name is managed: it carries the
+// prefix, or the marker if no prefix is configured, or it was adopted as a
+// legacy section.
+func (r *reconciler) owned(section parser.Section, name string) (bool, error) {
+	if r.legacy[sectionKind(section)+" "+name] {
+		return true, nil
+	}
+	if len(r.ownership.Prefix) > 0 {
+		return strings.HasPrefix(name, r.ownership.Prefix), nil
+	}
+	return r.marked(section, name)
+}
+
+// marked reports whether the mode line of the section named name carries the
+// marker.
+func (r *reconciler) marked(section parser.Section, name string) (bool, error) {
+	p, err := r.config.GetParser(r.transactionID)
+	if err != nil {
+		return false, err
+	}
+	raw, err := p.Get(section, name, "mode", false)
+	if err != nil {
+		return false, nil
+	}
+	mode, ok := raw.(*types.StringC)
+	return ok && mode.Comment == r.ownership.marker(), nil
+}
+
+// findLegacySections adopts the sections written before ownership was
+// tracked: unmarked frontends named dyna-frontend-<port> and the backends
+// they route to. Backends no such frontend routes to are left alone however
+// their servers are named, as they cannot be told apart from hand-written
+// ones. Adopted sections are marked when they are kept
+// and deleted when they are stale, so a renamed frontend does not stay bound
+// next to its replacement. They are found before anything changes, as
+// deleting a frontend loses the routes to its backends.
+func (r *reconciler) findLegacySections() error {
+	r.legacy = map[string]bool{}
+	_, frontends, err := r.config.GetFrontends(r.transactionID)
+	if err != nil {
+		return fmt.Errorf("unable to get frontends: %w", err)
+	}
+	for _, frontend := range frontends {
+		if !strings.HasPrefix(frontend.Name, legacyFrontendPrefix) {
+			continue
+		}
+		marked, err := r.marked(parser.Frontends, frontend.Name)
+		if err != nil {
+			return err
+		}
+		if marked {
+			continue
+		}
+		r.adoptLegacy(parser.Frontends, frontend.Name)
+		_, rules, err := r.config.GetBackendSwitchingRules(frontend.Name, r.transactionID)
+		if err != nil {
+			return fmt.Errorf("unable to get backend switching rules: %w", err)
+		}
+		for _, rule := range rules {
+			if !strings.Contains(rule.Name, "%[") {
+				r.adoptLegacy(parser.Backends, rule.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *reconciler) adoptLegacy(section parser.Section, name string) {
+	kind := sectionKind(section)
+	if !r.legacy[kind+" "+name] {
+		logrus.Infof("adopting unmarked legacy %s %s", kind, name)
+	}
+	r.legacy[kind+" "+name] = true
+}
+
+// claim fails unless the existing section named name is managed, so a section
+// an administrator wrote is never overwritten.
+func (r *reconciler) claim(section parser.Section, name string) error {
+	owned, err := r.owned(section, name)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return fmt.Errorf("%s %s exists and is not managed by haproxy-dyna-configure", sectionKind(section), name)
+	}
+	return nil
+}
+
+// mark writes the marker comment on the mode line of the section named name.
+// client-native drops the comment whenever it rewrites the section, so it is
+// put back after every create and edit.
+func (r *reconciler) mark(section parser.Section, name string) error {
+	p, err := r.config.GetParser(r.transactionID)
+	if err != nil {
+		return err
+	}
+	raw, err := p.Get(section, name, "mode", false)
+	if err != nil {
+		return fmt.Errorf("unable to mark %s %s: %w", sectionKind(section), name, err)
+	}
+	mode := raw.(*types.StringC)
+	if mode.Comment == r.ownership.marker() {
+		return nil
+	}
+	return p.Set(section, name, "mode", &types.StringC{Value: mode.Value, Comment: r.ownership.marker()})
+}
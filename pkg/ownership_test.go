@@ -0,0 +1,228 @@
+package pkg
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/haproxytech/client-native/configuration"
+)
+
+const handWrittenSections = `
+frontend bastion
+  mode tcp
+  bind 0.0.0.0:2222 name bastion
+  default_backend bastion
+
+backend bastion
+  mode tcp
+  server bastion 192.168.1.10:22
+`
+
+// addSections appends raw sections to configFile and reloads client.
+func addSections(t *testing.T, client *configuration.Client, configFile string, sections string) {
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configFile, append(raw, sections...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Init(client.ClientParams); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcilePreservesUnmanagedSections(t *testing.T) {
+	client, configFile := newTestClient(t)
+	addSections(t, client, configFile, handWrittenSections)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+
+	_, err := reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	_, err = reconcile(client, buildModel(nil, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"frontend bastion", "backend bastion", "frontend stats"} {
+		if !strings.Contains(string(raw), expected) {
+			t.Errorf("expected %q to be preserved:\n%s", expected, raw)
+		}
+	}
+	if strings.Contains(string(raw), "dyna-frontend") {
+		t.Errorf("expected managed sections to be removed:\n%s", raw)
+	}
+}
+
+func TestReconcileMarksManagedSections(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+
+	_, err := reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marked := strings.Count(string(raw), "mode tcp # "+DefaultOwnershipMarker)
+	if marked != 6 {
+		t.Errorf("expected 2 frontends and 4 backends to be marked, got %d:\n%s", marked, raw)
+	}
+
+	clusters := testClusters()
+	clusters[0].Ports[0].Balance = "leastconn"
+	_, err = reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err = os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marked := strings.Count(string(raw), "mode tcp # "+DefaultOwnershipMarker); marked != 6 {
+		t.Errorf("expected the marker to survive an edit, got %d:\n%s", marked, raw)
+	}
+}
+
+func TestReconcileRefusesUnmanagedSameName(t *testing.T) {
+	client, configFile := newTestClient(t)
+	addSections(t, client, configFile, `
+backend a.example.com-6443
+  mode tcp
+  server grafana 192.168.1.20:3000
+`)
+	before, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = reconcile(client, buildModel(testClusters(), testMonitorConfig(t, IpFamilyIPv4)))
+	if err == nil || !strings.Contains(err.Error(), "not managed") {
+		t.Fatalf("expected the unmanaged backend to be refused, got %v", err)
+	}
+	after, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("expected the configuration to be untouched:\n%s", after)
+	}
+}
+
+func TestReconcileAdoptsLegacySections(t *testing.T) {
+	client, configFile := newTestClient(t)
+	baseline, err := os.ReadFile("testdata/baseline-haproxy.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configFile, baseline, 0644); err != nil {
+		t.Fatal(err)
+	}
+	addSections(t, client, configFile, handWrittenSections+`
+frontend dyna-frontend-8443
+  mode tcp
+  bind 0.0.0.0:18443 name dyna-frontend-8443
+  use_backend old.example.com-8443 if { req.ssl_sni -m end .apps.old.example.com }
+
+backend old.example.com-8443
+  mode tcp
+  server router 192.168.86.2:8443
+`)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+
+	_, err = reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stale := range []string{"frontend dyna-frontend-443 ", "frontend dyna-frontend-6443 ", "frontend dyna-frontend-8443 ", "backend gone.example.com-6443 ", "backend old.example.com-8443 ", "-6443 192.168.88.2:6443"} {
+		if strings.Contains(string(raw), stale) {
+			t.Errorf("expected legacy %q to be removed:\n%s", stale, raw)
+		}
+	}
+	for _, expected := range []string{
+		"backend a.example.com-443 \n  mode tcp # " + DefaultOwnershipMarker,
+		"backend a.example.com-6443 \n  mode tcp # " + DefaultOwnershipMarker,
+		"frontend dyna-frontend-16443 \n  mode tcp # " + DefaultOwnershipMarker,
+		"frontend bastion",
+		"backend bastion",
+	} {
+		if !strings.Contains(string(raw), expected) {
+			t.Errorf("expected %q in configuration:\n%s", expected, raw)
+		}
+	}
+	if binds := strings.Count(string(raw), "bind 0.0.0.0:16443 "); binds != 1 {
+		t.Errorf("expected a single frontend bound to port 16443, got %d:\n%s", binds, raw)
+	}
+
+	result, err := reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) != 0 {
+		t.Errorf("expected no changes once adopted, got %v", result.Changes)
+	}
+}
+
+func TestReconcileKeepsHandWrittenBackendsNamedLikeLegacy(t *testing.T) {
+	for _, prefix := range []string{"", "ocp-"} {
+		client, configFile := newTestClient(t)
+		addSections(t, client, configFile, `
+backend ssh
+  mode tcp
+  server 10.0.0.5-22 10.0.0.5:22
+`)
+		monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+		monitorConfig.Ownership.Prefix = prefix
+
+		_, err := reconcile(client, buildModel(testClusters(), monitorConfig))
+		if err != nil {
+			t.Fatalf("prefix %q: failed: %s", prefix, err)
+		}
+		raw, err := os.ReadFile(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(raw), "backend ssh \n  mode tcp\n  server 10.0.0.5-22 10.0.0.5:22") {
+			t.Errorf("prefix %q: expected the hand-written backend to survive:\n%s", prefix, raw)
+		}
+	}
+}
+
+func TestReconcileOwnershipPrefix(t *testing.T) {
+	client, configFile := newTestClient(t)
+	addSections(t, client, configFile, handWrittenSections)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	monitorConfig.Ownership.Prefix = "ocp-"
+
+	model := buildModel(testClusters(), monitorConfig)
+	if model.backend("ocp-a.example.com-6443") == nil || model.frontend("ocp-dyna-frontend-16443") == nil {
+		t.Fatal("expected generated names to carry the prefix")
+	}
+	_, err := reconcile(client, model)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	_, err = reconcile(client, buildModel(nil, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "ocp-") || !strings.Contains(string(raw), "backend bastion") {
+		t.Errorf("expected only prefixed sections to be removed:\n%s", raw)
+	}
+}
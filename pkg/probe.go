@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ProbeHTTP = "http"
+	ProbeTLS  = "tls"
+	ProbeTCP  = "tcp"
+)
+
+// probeTarget checks whether address answers using the given probe mode and
+// returns the peer certificates presented, if any. A nil error means the
+// target is alive.
+func probeTarget(ctx context.Context, probe string, protocol string, address string, timeout time.Duration) ([]*x509.Certificate, error) {
+	switch probe {
+	case ProbeTLS:
+		return probeTLS(ctx, address, timeout)
+	case ProbeTCP:
+		return nil, probeTCP(ctx, address, timeout)
+	case "", ProbeHTTP:
+		return probeHTTP(ctx, protocol, address, timeout)
+	}
+	return nil, fmt.Errorf("unknown probe %s", probe)
+}
+
+func probeHTTP(ctx context.Context, protocol string, address string, timeout time.Duration) ([]*x509.Certificate, error) {
+	client := http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	url := fmt.Sprintf("%s://%s", protocol, address)
+	logrus.Debugf("checking URL %s", url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.TLS == nil {
+		return nil, nil
+	}
+	return resp.TLS.PeerCertificates, nil
+}
+
+// probeTLS completes a TLS handshake without sending a request, for endpoints
+// that terminate TLS but never answer HTTP in time.
+func probeTLS(ctx context.Context, address string, timeout time.Duration) ([]*x509.Certificate, error) {
+	logrus.Debugf("checking TLS %s", address)
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: timeout},
+		Config:    &tls.Config{InsecureSkipVerify: true},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.(*tls.Conn).ConnectionState().PeerCertificates, nil
+}
+
+func probeTCP(ctx context.Context, address string, timeout time.Duration) error {
+	logrus.Debugf("checking TCP %s", address)
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProbeTarget(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	for _, probe := range []string{ProbeHTTP, ProbeTLS} {
+		certs, err := probeTarget(context.Background(), probe, "https", address, time.Second)
+		if err != nil {
+			t.Fatalf("%s probe failed: %s", probe, err)
+		}
+		if len(certs) == 0 || len(certs[0].DNSNames) == 0 {
+			t.Errorf("%s probe returned no certificate names", probe)
+		}
+	}
+
+	certs, err := probeTarget(context.Background(), ProbeTCP, "", address, time.Second)
+	if err != nil {
+		t.Fatalf("tcp probe failed: %s", err)
+	}
+	if certs != nil {
+		t.Error("tcp probe should not return certificates")
+	}
+}
+
+func TestProbeTargetClosedPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	for _, probe := range []string{ProbeHTTP, ProbeTLS, ProbeTCP} {
+		if _, err := probeTarget(context.Background(), probe, "https", address, time.Second); err == nil {
+			t.Errorf("%s probe of a closed port should fail", probe)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/netdata/go.d.plugin/pkg/iprange"
+	"github.com/pkg/errors"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+const (
+	maxRangeAddresses = 65536
+
+	// DefaultSparseHosts is the number of addresses probed at the start of
+	// each IPv6 range unless the range sets sparse-hosts.
+	DefaultSparseHosts = 256
+)
+
+type addrRange struct {
+	start netip.Addr
+	end   netip.Addr
+}
+
+func (r addrRange) contains(addr netip.Addr) bool {
+	return r.start.Compare(addr) <= 0 && r.end.Compare(addr) >= 0
+}
+
+// rangeSpecs returns every range expression configured on monitorRange.
+func rangeSpecs(monitorRange *data.MonitorRange) []string {
+	specs := []string{}
+	if len(monitorRange.IpAddressStart) > 0 {
+		end := monitorRange.IpAddressEnd
+		if len(end) == 0 {
+			end = monitorRange.IpAddressStart
+		}
+		specs = append(specs, fmt.Sprintf("%s-%s", monitorRange.IpAddressStart, end))
+	}
+	if len(monitorRange.Cidr) > 0 {
+		specs = append(specs, monitorRange.Cidr)
+	}
+	return append(specs, monitorRange.Ranges...)
+}
+
+func describeRange(monitorRange *data.MonitorRange) string {
+	return strings.Join(rangeSpecs(monitorRange), ",")
+}
+
+// parseRangeSpec parses an address, a start-end range, a CIDR or a shorthand
+// range such as 192.168.88.2-10 where the end only replaces the last octet.
+func parseRangeSpec(spec string) (addrRange, error) {
+	spec = strings.TrimSpace(spec)
+	if idx := strings.IndexByte(spec, '-'); idx != -1 {
+		start, end := spec[:idx], spec[idx+1:]
+		if !strings.ContainsAny(end, ".:") {
+			sep := "."
+			if strings.Contains(start, ":") {
+				sep = ":"
+			}
+			end = start[:strings.LastIndex(start, sep)+1] + end
+		}
+		spec = fmt.Sprintf("%s-%s", start, end)
+	}
+
+	parsed, err := iprange.ParseRange(spec)
+	if err != nil {
+		return addrRange{}, err
+	}
+	if parsed == nil {
+		return addrRange{}, errors.Errorf("ip range (%s) is empty", spec)
+	}
+	bounds := strings.SplitN(parsed.String(), "-", 2)
+	start, err := netip.ParseAddr(bounds[0])
+	if err != nil {
+		return addrRange{}, err
+	}
+	end, err := netip.ParseAddr(bounds[1])
+	if err != nil {
+		return addrRange{}, err
+	}
+	return addrRange{start: start.Unmap(), end: end.Unmap()}, nil
+}
+
+// expandRange returns the addresses to probe for monitorRange in ascending
+// order with duplicates and excluded addresses removed. IPv6 prefixes are far
+// too large to walk, so only the first sparse-hosts addresses of each IPv6
+// range are probed.
+func expandRange(monitorRange *data.MonitorRange) ([]netip.Addr, error) {
+	excludes := []addrRange{}
+	for _, spec := range monitorRange.Exclude {
+		exclude, err := parseRangeSpec(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid exclude %s", spec)
+		}
+		excludes = append(excludes, exclude)
+	}
+
+	sparseHosts := monitorRange.SparseHosts
+	if sparseHosts <= 0 {
+		sparseHosts = DefaultSparseHosts
+	}
+
+	seen := map[netip.Addr]bool{}
+	addrs := []netip.Addr{}
+	for _, spec := range rangeSpecs(monitorRange) {
+		include, err := parseRangeSpec(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid range %s", spec)
+		}
+		walked := 0
+		for addr := include.start; addr.IsValid() && include.contains(addr); addr = addr.Next() {
+			if include.start.Is6() && walked >= sparseHosts {
+				break
+			}
+			walked++
+			if seen[addr] || excluded(addr, excludes) {
+				continue
+			}
+			if len(addrs) >= maxRangeAddresses {
+				return nil, errors.Errorf("range %s has more than %d addresses", spec, maxRangeAddresses)
+			}
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Less(addrs[j])
+	})
+	return addrs, nil
+}
+
+func excluded(addr netip.Addr, excludes []addrRange) bool {
+	for _, exclude := range excludes {
+		if exclude.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
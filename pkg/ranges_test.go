@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func addrStrings(addrs []netip.Addr) []string {
+	out := []string{}
+	for _, addr := range addrs {
+		out = append(out, addr.String())
+	}
+	return out
+}
+
+func TestExpandRange(t *testing.T) {
+	tests := []struct {
+		name         string
+		monitorRange data.MonitorRange
+		expected     []string
+	}{
+		{
+			name: "start and end",
+			monitorRange: data.MonitorRange{
+				IpAddressStart: "192.168.88.2",
+				IpAddressEnd:   "192.168.88.4",
+			},
+			expected: []string{"192.168.88.2", "192.168.88.3", "192.168.88.4"},
+		},
+		{
+			name: "cidr skips network and broadcast",
+			monitorRange: data.MonitorRange{
+				Cidr: "192.168.88.0/30",
+			},
+			expected: []string{"192.168.88.1", "192.168.88.2"},
+		},
+		{
+			name: "shorthand ranges with exclusions",
+			monitorRange: data.MonitorRange{
+				Ranges:  []string{"192.168.88.2-6", "192.168.89.10"},
+				Exclude: []string{"192.168.88.3", "192.168.88.5-6"},
+			},
+			expected: []string{"192.168.88.2", "192.168.88.4", "192.168.89.10"},
+		},
+		{
+			name: "overlapping ranges are de-duplicated",
+			monitorRange: data.MonitorRange{
+				Cidr:   "192.168.88.0/30",
+				Ranges: []string{"192.168.88.2-3"},
+			},
+			expected: []string{"192.168.88.1", "192.168.88.2", "192.168.88.3"},
+		},
+		{
+			name: "ipv6 shorthand",
+			monitorRange: data.MonitorRange{
+				Ranges: []string{"fd00:88::a-c"},
+			},
+			expected: []string{"fd00:88::a", "fd00:88::b", "fd00:88::c"},
+		},
+		{
+			name: "sparse ipv6 prefix",
+			monitorRange: data.MonitorRange{
+				Cidr:        "fd00:88::/64",
+				SparseHosts: 3,
+				Exclude:     []string{"fd00:88::2"},
+			},
+			expected: []string{"fd00:88::1", "fd00:88::3"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addrs, err := expandRange(&test.monitorRange)
+			if err != nil {
+				t.Fatalf("failed: %s", err)
+			}
+			if actual := addrStrings(addrs); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestExpandRangeInvalid(t *testing.T) {
+	_, err := expandRange(&data.MonitorRange{Ranges: []string{"192.168.88.10-2"}})
+	if err == nil {
+		t.Error("expected an error for a reversed range")
+	}
+	_, err = expandRange(&data.MonitorRange{Cidr: "10.0.0.0/8"})
+	if err == nil {
+		t.Error("expected an error for an oversized range")
+	}
+}
@@ -0,0 +1,795 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/haproxytech/client-native/configuration"
+	parser "github.com/haproxytech/config-parser"
+	"github.com/haproxytech/config-parser/params"
+	"github.com/haproxytech/config-parser/parsers/tcp/actions"
+	"github.com/haproxytech/config-parser/types"
+	"github.com/haproxytech/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxTransactionAttempts = 3
+)
+
+var errVersionConflict = errors.New("configuration was changed by another writer")
+
+// reconciler applies the difference between a desired haproxyModel and the
+// configuration held by a configuration.Client within a single transaction,
+// touching only the objects that changed.
+type reconciler struct {
+	config        *configuration.Client
+	transactionID string
+	ownership     ownership
+	result        reconcileResult
+
+	// legacy holds the sections written before ownership was tracked,
+	// keyed by kind and name, which are adopted as managed.
+	legacy map[string]bool
+
+	// mapBackups holds the content of every map file rewritten during the
+	// transaction, nil for maps that did not exist, so they can be put back
+	// if the transaction is not committed.
+	mapBackups map[string][]byte
+
+	// dryRun leaves map files untouched and keeps their new content, nil
+	// for maps that would be removed, in mapContents instead.
+	dryRun      bool
+	mapContents map[string][]byte
+}
+
+// reconcileResult describes the changes committed by a reconcile. When
+// ReloadRequired is false every change was to a server slot or a map entry,
+// and running HAProxy can be brought up to date by applying ServerUpdates and
+// MapUpdates through the runtime API.
+type reconcileResult struct {
+	Changes        []string
+	ReloadRequired bool
+	ServerUpdates  []serverUpdate
+	MapUpdates     []mapUpdate
+
+	// MapBackups holds the previous content of every map file written, nil
+	// for maps that did not exist, so they can be put back together with
+	// the configuration when it fails validation.
+	MapBackups map[string][]byte
+}
+
+// reconcile brings config in line with desired. An empty Changes means the
+// configuration was untouched. If another writer changes the configuration
+// while the transaction is open, the configuration is re-read and the
+// reconcile retried.
+func reconcile(config *configuration.Client, desired *haproxyModel) (*reconcileResult, error) {
+	var err error
+	for attempt := 1; attempt <= maxTransactionAttempts; attempt++ {
+		var result *reconcileResult
+		result, err = reconcileTransaction(config, desired)
+		if !isVersionConflict(err) {
+			return result, err
+		}
+		logrus.Warnf("attempt %d of %d: %s", attempt, maxTransactionAttempts, err)
+		initErr := config.Init(config.ClientParams)
+		if initErr != nil {
+			return nil, fmt.Errorf("unable to reload configuration: %w", initErr)
+		}
+	}
+	return nil, err
+}
+
+// reconcileTransaction applies desired in one transaction that is committed
+// only if every change succeeded and is discarded otherwise.
+func reconcileTransaction(config *configuration.Client, desired *haproxyModel) (*reconcileResult, error) {
+	version, err := config.GetVersion("")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get config version: %w", err)
+	}
+	transaction, err := config.StartTransaction(version)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start transaction: %w", err)
+	}
+
+	r := &reconciler{config: config, transactionID: transaction.ID, ownership: desired.Ownership, mapBackups: map[string][]byte{}}
+	committed := false
+	defer func() {
+		if !committed {
+			r.restoreMaps()
+		}
+	}()
+	err = r.apply(desired)
+	if err != nil {
+		config.DeleteTransaction(transaction.ID)
+		return nil, err
+	}
+	if len(r.result.Changes) == 0 {
+		return &r.result, config.DeleteTransaction(transaction.ID)
+	}
+
+	onDisk, err := configFileVersion(config.ConfigurationFile)
+	if err != nil {
+		config.DeleteTransaction(transaction.ID)
+		return nil, err
+	}
+	if onDisk != version {
+		config.DeleteTransaction(transaction.ID)
+		return nil, fmt.Errorf("%w: version on disk is %d, transaction started at %d", errVersionConflict, onDisk, version)
+	}
+
+	_, err = config.CommitTransaction(transaction.ID)
+	if err != nil {
+		config.DeleteTransaction(transaction.ID)
+		return nil, fmt.Errorf("unable to commit transaction: %w", err)
+	}
+	committed = true
+	r.result.MapBackups = r.mapBackups
+	return &r.result, nil
+}
+
+// configFileVersion reads the version client-native keeps at the top of the
+// configuration file, which may have been bumped by another writer since the
+// client loaded it.
+func configFileVersion(configFile string) (int64, error) {
+	p := &parser.Parser{}
+	err := p.LoadData(configFile)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read %s: %w", configFile, err)
+	}
+	raw, _ := p.Get(parser.Comments, parser.CommentsSectionName, "# _version", true)
+	version, ok := raw.(*types.ConfigVersion)
+	if !ok {
+		return 0, fmt.Errorf("unable to read version of %s", configFile)
+	}
+	return version.Value, nil
+}
+
+func isVersionConflict(err error) bool {
+	if errors.Is(err, errVersionConflict) {
+		return true
+	}
+	var confErr *configuration.ConfError
+	return errors.As(err, &confErr) && confErr.Code() == configuration.ErrVersionMismatch
+}
+
+// record notes a change that only takes effect after HAProxy is reloaded.
+func (r *reconciler) record(format string, args ...interface{}) {
+	r.result.Changes = append(r.result.Changes, fmt.Sprintf(format, args...))
+	r.result.ReloadRequired = true
+}
+
+// recordServerUpdate notes a server slot change that can also be applied to
+// the running HAProxy through the runtime API.
+func (r *reconciler) recordServerUpdate(update serverUpdate) {
+	change := fmt.Sprintf("drain server %s/%s", update.Backend, update.Server)
+	if update.Ready {
+		change = fmt.Sprintf("fill server %s/%s with %s", update.Backend, update.Server, net.JoinHostPort(update.Address, strconv.FormatInt(update.Port, 10)))
+	}
+	if update.Weight != nil {
+		change = fmt.Sprintf("%s, weight %d", change, *update.Weight)
+	}
+	r.result.Changes = append(r.result.Changes, change)
+	r.result.ServerUpdates = append(r.result.ServerUpdates, update)
+}
+
+// recordMapUpdate notes a map entry change that can also be applied to the
+// running HAProxy through the runtime API.
+func (r *reconciler) recordMapUpdate(update mapUpdate) {
+	r.result.Changes = append(r.result.Changes, update.String())
+	r.result.MapUpdates = append(r.result.MapUpdates, update)
+}
+
+// apply sets the managed global and defaults directives, creates backends
+// before the frontends that route to them and removes stale frontends before
+// the backends they referenced. Sections that are not managed are left alone.
+func (r *reconciler) apply(desired *haproxyModel) error {
+	err := r.findLegacySections()
+	if err != nil {
+		return err
+	}
+	if desired.Settings != nil {
+		err := r.syncSettings(desired.Settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, backends, err := r.config.GetBackends(r.transactionID)
+	if err != nil {
+		return fmt.Errorf("unable to get backends: %w", err)
+	}
+	currentBackends := map[string]*models.Backend{}
+	for _, backend := range backends {
+		currentBackends[backend.Name] = backend
+	}
+	for _, backend := range desired.Backends {
+		err = r.syncBackend(backend, currentBackends[backend.Backend.Name])
+		if err != nil {
+			return err
+		}
+	}
+
+	_, frontends, err := r.config.GetFrontends(r.transactionID)
+	if err != nil {
+		return fmt.Errorf("unable to get frontends: %w", err)
+	}
+	currentFrontends := map[string]*models.Frontend{}
+	for _, frontend := range frontends {
+		currentFrontends[frontend.Name] = frontend
+	}
+	for _, frontend := range desired.Frontends {
+		err = r.syncFrontend(frontend, currentFrontends[frontend.Frontend.Name])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, frontend := range frontends {
+		if desired.frontend(frontend.Name) != nil {
+			continue
+		}
+		owned, err := r.owned(parser.Frontends, frontend.Name)
+		if err != nil {
+			return err
+		}
+		if !owned {
+			continue
+		}
+		paths, err := r.frontendMaps(frontend.Name)
+		if err != nil {
+			return err
+		}
+		err = r.config.DeleteFrontend(frontend.Name, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to delete frontend: %w", err)
+		}
+		r.record("delete frontend %s", frontend.Name)
+		for _, path := range paths {
+			err = r.removeMap(path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, backend := range backends {
+		if desired.backend(backend.Name) != nil || desired.defaultBackend(backend.Name) {
+			continue
+		}
+		owned, err := r.owned(parser.Backends, backend.Name)
+		if err != nil {
+			return err
+		}
+		if !owned {
+			continue
+		}
+		err = r.config.DeleteBackend(backend.Name, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to delete backend: %w", err)
+		}
+		r.record("delete backend %s", backend.Name)
+	}
+	return nil
+}
+
+func (r *reconciler) syncBackend(desired *backendModel, current *models.Backend) error {
+	name := desired.Backend.Name
+	var err error
+	if current == nil {
+		err = r.config.CreateBackend(&desired.Backend, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to create backend: %w", err)
+		}
+		r.record("create backend %s", name)
+	} else if err = r.claim(parser.Backends, name); err != nil {
+		return err
+	} else if !reflect.DeepEqual(*current, desired.Backend) {
+		err = r.config.EditBackend(name, &desired.Backend, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to update backend: %w", err)
+		}
+		r.record("update backend %s", name)
+	}
+	err = r.mark(parser.Backends, name)
+	if err != nil {
+		return err
+	}
+	err = r.syncStickRules(name, desired.StickRules)
+	if err != nil {
+		return err
+	}
+
+	currentServers, err := r.servers(name)
+	if err != nil {
+		return err
+	}
+	currentParams, err := r.serverParams(name)
+	if err != nil {
+		return err
+	}
+	existing := map[string]*models.Server{}
+	for _, server := range currentServers {
+		existing[server.Name] = server
+	}
+	wanted := map[string]bool{}
+	for _, server := range stabilizeSlots(desired.Servers, currentServers) {
+		wanted[server.Name] = true
+		currentServer, ok := existing[server.Name]
+		if !ok {
+			err = r.config.CreateServer(name, server, r.transactionID, 0)
+			if err != nil {
+				return fmt.Errorf("unable to create server: %w", err)
+			}
+			r.record("create server %s/%s", name, server.Name)
+		} else if !reflect.DeepEqual(currentServer, server) {
+			err = r.config.EditServer(server.Name, name, server, r.transactionID, 0)
+			if err != nil {
+				return fmt.Errorf("unable to update server: %w", err)
+			}
+			update, ok := runtimeUpdate(name, server, currentServer)
+			if ok {
+				r.recordServerUpdate(update)
+			} else {
+				r.record("update server %s/%s", name, server.Name)
+			}
+		}
+	}
+	for _, server := range currentServers {
+		if wanted[server.Name] {
+			continue
+		}
+		err = r.config.DeleteServer(server.Name, name, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to delete server: %w", err)
+		}
+		r.record("delete server %s/%s", name, server.Name)
+	}
+	return r.syncServerParams(name, desired.ServerParams, currentParams)
+}
+
+func (r *reconciler) syncFrontend(desired *frontendModel, current *models.Frontend) error {
+	name := desired.Frontend.Name
+	var err error
+	if current == nil {
+		err = r.config.CreateFrontend(&desired.Frontend, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to create frontend: %w", err)
+		}
+		r.record("create frontend %s", name)
+	} else if err = r.claim(parser.Frontends, name); err != nil {
+		return err
+	} else if !reflect.DeepEqual(*current, desired.Frontend) {
+		err = r.config.EditFrontend(name, &desired.Frontend, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to update frontend: %w", err)
+		}
+		r.record("update frontend %s", name)
+	}
+	err = r.mark(parser.Frontends, name)
+	if err != nil {
+		return err
+	}
+
+	err = r.syncBinds(name, desired.Binds)
+	if err != nil {
+		return err
+	}
+	err = r.syncTCPRequestRules(name, desired.TCPRequestRules)
+	if err != nil {
+		return err
+	}
+	err = r.syncBackendSwitchingRules(name, desired.SwitchingRules)
+	if err != nil {
+		return err
+	}
+	err = r.syncFrontendDirectives(name, desired.Directives)
+	if err != nil {
+		return err
+	}
+	if desired.SNIMap == nil {
+		return nil
+	}
+	for _, file := range desired.SNIMap.files() {
+		err = r.syncMap(file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncMap rewrites the map file of a frontend when its entries differ from
+// desired. The file is written before the transaction is committed so the
+// configuration check finds it.
+func (r *reconciler) syncMap(desired *mapFile) error {
+	current, raw, err := readMapFile(desired.Path)
+	if err != nil {
+		return err
+	}
+	updates := diffMap(current, desired)
+	content := desired.render()
+	if current != nil && bytes.Equal(raw, content) {
+		return nil
+	}
+	err = r.writeMap(desired.Path, raw, current != nil, content)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		r.record("create map %s", desired.Path)
+		return nil
+	}
+	if len(updates) == 0 {
+		r.record("reorder map %s", desired.Path)
+		return nil
+	}
+	for _, update := range updates {
+		if shadow := current.shadowingEntry(update); len(shadow) > 0 {
+			r.record("add %s to map %s ahead of %s", update.Key, update.Path, shadow)
+			continue
+		}
+		r.recordMapUpdate(update)
+	}
+	return nil
+}
+
+func (r *reconciler) writeMap(path string, previous []byte, existed bool, content []byte) error {
+	if _, ok := r.mapBackups[path]; !ok {
+		if existed && previous == nil {
+			previous = []byte{}
+		}
+		r.mapBackups[path] = previous
+	}
+	if r.dryRun {
+		r.mapContents[path] = content
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create map directory: %w", err)
+	}
+	err = os.WriteFile(path, content, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write map %s: %w", path, err)
+	}
+	return nil
+}
+
+// frontendMaps returns the map files the use_backend rules of frontend look
+// up.
+func (r *reconciler) frontendMaps(frontend string) ([]string, error) {
+	_, rules, err := r.config.GetBackendSwitchingRules(frontend, r.transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get backend switching rules: %w", err)
+	}
+	paths := []string{}
+	for _, rule := range rules {
+		match := mapRulePattern.FindStringSubmatch(rule.Name)
+		if match != nil {
+			paths = append(paths, match[1])
+		}
+	}
+	return paths, nil
+}
+
+// removeMap deletes the map file of a frontend that is no longer managed.
+func (r *reconciler) removeMap(path string) error {
+	_, raw, err := readMapFile(path)
+	if err != nil || raw == nil {
+		return err
+	}
+	if _, ok := r.mapBackups[path]; !ok {
+		r.mapBackups[path] = raw
+	}
+	if r.dryRun {
+		r.mapContents[path] = nil
+	} else if err = os.Remove(path); err != nil {
+		return fmt.Errorf("unable to remove map %s: %w", path, err)
+	}
+	r.record("delete map %s", path)
+	return nil
+}
+
+// restoreMaps puts back every map file changed by an uncommitted transaction.
+func (r *reconciler) restoreMaps() {
+	restoreMapFiles(r.mapBackups)
+}
+
+// restoreMapFiles writes back the map files saved in backups and removes the
+// ones that did not exist.
+func restoreMapFiles(backups map[string][]byte) {
+	for path, previous := range backups {
+		var err error
+		if previous == nil {
+			err = os.Remove(path)
+		} else {
+			err = os.WriteFile(path, previous, 0644)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("unable to restore map %s: %s", path, err)
+		}
+	}
+}
+
+func (r *reconciler) syncBinds(frontend string, desired models.Binds) error {
+	currentBinds, err := r.binds(frontend)
+	if err != nil {
+		return err
+	}
+	existing := map[string]*models.Bind{}
+	for _, bind := range currentBinds {
+		existing[bind.Name] = bind
+	}
+	wanted := map[string]bool{}
+	for _, bind := range desired {
+		wanted[bind.Name] = true
+		currentBind, ok := existing[bind.Name]
+		if !ok {
+			err = r.config.CreateBind(frontend, bind, r.transactionID, 0)
+			if err != nil {
+				return fmt.Errorf("unable to create bind: %w", err)
+			}
+			r.record("create bind %s/%s", frontend, bind.Name)
+		} else if !reflect.DeepEqual(currentBind, bind) {
+			err = r.config.EditBind(bind.Name, frontend, bind, r.transactionID, 0)
+			if err != nil {
+				return fmt.Errorf("unable to update bind: %w", err)
+			}
+			r.record("update bind %s/%s", frontend, bind.Name)
+		}
+	}
+	for _, bind := range currentBinds {
+		if wanted[bind.Name] {
+			continue
+		}
+		err = r.config.DeleteBind(bind.Name, frontend, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to delete bind: %w", err)
+		}
+		r.record("delete bind %s/%s", frontend, bind.Name)
+	}
+	return nil
+}
+
+// syncTCPRequestRules replaces the rules of frontend when they differ from
+// desired. Rule order is significant, so the list is rewritten as a whole.
+// client-native only reads accept and reject rules back, so the rules are
+// compared and written through the parser to keep the unknown SNI counting
+// rules in place.
+func (r *reconciler) syncTCPRequestRules(frontend string, desired models.TCPRequestRules) error {
+	p, err := r.config.GetParser(r.transactionID)
+	if err != nil {
+		return err
+	}
+	current := []string{}
+	raw, err := p.Get(parser.Frontends, frontend, "tcp-request", false)
+	if err == nil {
+		for _, action := range raw.([]types.TCPAction) {
+			current = append(current, action.String())
+		}
+	}
+	wanted := []string{}
+	rules := []types.TCPAction{}
+	for _, rule := range desired {
+		action := tcpAction(rule)
+		wanted = append(wanted, action.String())
+		rules = append(rules, action)
+	}
+	if reflect.DeepEqual(current, wanted) {
+		return nil
+	}
+	err = p.Set(parser.Frontends, frontend, "tcp-request", rules)
+	if err != nil {
+		return fmt.Errorf("unable to set TCP request rules: %w", err)
+	}
+	r.record("replace TCP request rules of %s", frontend)
+	return nil
+}
+
+// tcpAction returns the parser form of rule. Unlike client-native it keeps
+// the arguments of actions other than accept and reject.
+func tcpAction(rule *models.TCPRequestRule) types.TCPAction {
+	switch rule.Type {
+	case models.TCPRequestRuleTypeInspectDelay:
+		return &actions.InspectDelay{Timeout: strconv.FormatInt(*rule.Timeout, 10)}
+	case models.TCPRequestRuleTypeConnection:
+		return &actions.Connection{Action: strings.Fields(rule.Action), Cond: rule.Cond, CondTest: rule.CondTest}
+	case models.TCPRequestRuleTypeSession:
+		return &actions.Session{Action: strings.Fields(rule.Action), Cond: rule.Cond, CondTest: rule.CondTest}
+	}
+	return &actions.Content{Action: strings.Fields(rule.Action), Cond: rule.Cond, CondTest: rule.CondTest}
+}
+
+// syncBackendSwitchingRules replaces the use_backend rules of frontend when
+// they differ from desired.
+func (r *reconciler) syncBackendSwitchingRules(frontend string, desired models.BackendSwitchingRules) error {
+	_, current, err := r.config.GetBackendSwitchingRules(frontend, r.transactionID)
+	if err != nil {
+		return fmt.Errorf("unable to get backend switching rules: %w", err)
+	}
+	if (len(current) == 0 && len(desired) == 0) || reflect.DeepEqual(current, desired) {
+		return nil
+	}
+	for idx := len(current) - 1; idx >= 0; idx-- {
+		err = r.config.DeleteBackendSwitchingRule(*current[idx].ID, frontend, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to delete backend switching rule: %w", err)
+		}
+	}
+	for _, rule := range desired {
+		err = r.config.CreateBackendSwitchingRule(frontend, rule, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to create backend switching rule: %w", err)
+		}
+	}
+	r.record("replace backend switching rules of %s", frontend)
+	return nil
+}
+
+func (r *reconciler) syncStickRules(backend string, desired models.StickRules) error {
+	_, current, err := r.config.GetStickRules(backend, r.transactionID)
+	if err != nil {
+		return fmt.Errorf("unable to get stick rules: %w", err)
+	}
+	if (len(current) == 0 && len(desired) == 0) || reflect.DeepEqual(current, desired) {
+		return nil
+	}
+	for idx := len(current) - 1; idx >= 0; idx-- {
+		err = r.config.DeleteStickRule(*current[idx].ID, backend, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to delete stick rule: %w", err)
+		}
+	}
+	for _, rule := range desired {
+		err = r.config.CreateStickRule(backend, rule, r.transactionID, 0)
+		if err != nil {
+			return fmt.Errorf("unable to create stick rule: %w", err)
+		}
+	}
+	r.record("replace stick rules of %s", backend)
+	return nil
+}
+
+// serverParams returns the managed raw options of every server of backend,
+// keyed by server name.
+func (r *reconciler) serverParams(backend string) (map[string]string, error) {
+	p, err := r.config.GetParser(r.transactionID)
+	if err != nil {
+		return nil, err
+	}
+	current := map[string]string{}
+	raw, err := p.Get(parser.Backends, backend, "server", false)
+	if err != nil {
+		return current, nil
+	}
+	for _, server := range raw.([]types.Server) {
+		current[server.Name] = formatServerParams(managedParams(server.Params))
+	}
+	return current, nil
+}
+
+func managedParams(options []params.ServerOption) []params.ServerOption {
+	managed := []params.ServerOption{}
+	for _, option := range options {
+		if managedServerParams[serverParamName(option)] {
+			managed = append(managed, option)
+		}
+	}
+	return managed
+}
+
+func serverParamName(option params.ServerOption) string {
+	fields := strings.Fields(option.String())
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func formatServerParams(options []params.ServerOption) string {
+	parts := []string{}
+	for _, option := range options {
+		parts = append(parts, option.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// syncServerParams sets desired as the managed raw options of every server of
+// backend. client-native drops options it does not model whenever it
+// rewrites a server, so they are put back after the servers were synced and
+// only servers whose options differ from before the sync are reported.
+func (r *reconciler) syncServerParams(backend string, desired []params.ServerOption, current map[string]string) error {
+	p, err := r.config.GetParser(r.transactionID)
+	if err != nil {
+		return err
+	}
+	raw, err := p.Get(parser.Backends, backend, "server", false)
+	if err != nil {
+		return nil
+	}
+	servers := raw.([]types.Server)
+	want := formatServerParams(desired)
+	for idx, server := range servers {
+		options := []params.ServerOption{}
+		for _, option := range server.Params {
+			if !managedServerParams[serverParamName(option)] {
+				options = append(options, option)
+			}
+		}
+		servers[idx].Params = append(options, desired...)
+		previous, existed := current[server.Name]
+		if existed && previous != want {
+			r.record("update check options of server %s/%s", backend, server.Name)
+		}
+	}
+	return p.Set(parser.Backends, backend, "server", servers)
+}
+
+// servers returns the servers of backend. client-native splits addresses on
+// the first colon, so address and port are re-read from the raw configuration
+// to keep bracketed IPv6 servers comparable with the desired model.
+func (r *reconciler) servers(backend string) (models.Servers, error) {
+	_, servers, err := r.config.GetServers(backend, r.transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get servers: %w", err)
+	}
+	p, err := r.config.GetParser(r.transactionID)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := p.Get(parser.Backends, backend, "server", false)
+	if err != nil {
+		return servers, nil
+	}
+	for _, rawServer := range raw.([]types.Server) {
+		for _, server := range servers {
+			if server.Name == rawServer.Name {
+				server.Address, server.Port = splitAddressPort(rawServer.Address)
+			}
+		}
+	}
+	return servers, nil
+}
+
+// binds returns the binds of frontend with addresses re-read from the raw
+// configuration, as client-native reports [::] as ::.
+func (r *reconciler) binds(frontend string) (models.Binds, error) {
+	_, binds, err := r.config.GetBinds(frontend, r.transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get binds: %w", err)
+	}
+	p, err := r.config.GetParser(r.transactionID)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := p.Get(parser.Frontends, frontend, "bind", false)
+	if err != nil {
+		return binds, nil
+	}
+	for idx, rawBind := range raw.([]types.Bind) {
+		if idx < len(binds) && !strings.HasPrefix(rawBind.Path, "/") {
+			binds[idx].Address, binds[idx].Port = splitAddressPort(rawBind.Path)
+		}
+	}
+	return binds, nil
+}
+
+func splitAddressPort(address string) (string, *int64) {
+	idx := strings.LastIndex(address, ":")
+	if idx == -1 || strings.HasSuffix(address, "]") {
+		return address, nil
+	}
+	port, err := strconv.ParseInt(address[idx+1:], 10, 64)
+	if err != nil {
+		return address, nil
+	}
+	return address[:idx], &port
+}
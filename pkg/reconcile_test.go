@@ -0,0 +1,217 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/haproxytech/client-native/configuration"
+	"github.com/haproxytech/models"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+// newTestClient returns a configuration client backed by a scratch copy of
+// testdata/haproxy.cfg. haproxy is not available, so /bin/true stands in for
+// the configuration check.
+func newTestClient(t *testing.T) (*configuration.Client, string) {
+	dir := t.TempDir()
+	raw, err := os.ReadFile("testdata/haproxy.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "haproxy.cfg")
+	if err := os.WriteFile(configFile, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := &configuration.Client{}
+	err = client.Init(configuration.ClientParams{
+		ConfigurationFile: configFile,
+		Haproxy:           "/bin/true",
+		UseValidation:     true,
+		TransactionDir:    filepath.Join(dir, "tx"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, configFile
+}
+
+func testClusters() []data.Cluster {
+	return []data.Cluster{
+		{
+			BaseDomain: "a.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 6443, PathMatch: "api", Targets: []string{"192.168.88.2", "fd00::2"}},
+				{Port: 443, PathPrefix: "*.apps", Targets: []string{"192.168.88.3"}},
+			},
+		},
+		{
+			BaseDomain: "b.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 6443, PathMatch: "api", Targets: []string{"192.168.89.2"}},
+			},
+		},
+	}
+}
+
+func testMonitorConfig(t *testing.T, ipFamily string) *data.MonitorConfig {
+	return &data.MonitorConfig{IpFamily: ipFamily, ServerSlots: 4, MapDir: t.TempDir()}
+}
+
+func TestReconcileIsIncremental(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyDual)
+
+	result, err := reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) == 0 || !result.ReloadRequired {
+		t.Fatal("expected changes requiring a reload on first reconcile")
+	}
+	sniMap, err := os.ReadFile(filepath.Join(monitorConfig.MapDir, "dyna-frontend-16443.exact.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sniMap) != "api.a.example.com a.example.com-6443\napi.b.example.com b.example.com-6443\n" {
+		t.Errorf("unexpected map:\n%s", sniMap)
+	}
+
+	result, err = reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) != 0 {
+		t.Errorf("expected no changes, got %v", result.Changes)
+	}
+
+	clusters := testClusters()[:1]
+	clusters[0].Ports[0].Targets = []string{"192.168.88.2", "192.168.88.4"}
+	result, err = reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	expected := []string{
+		"fill server a.example.com-6443/slot2 with 192.168.88.4:6443",
+		"del map " + filepath.Join(monitorConfig.MapDir, "dyna-frontend-16443.exact.map") + " api.b.example.com",
+		"delete backend b.example.com-6443",
+	}
+	if strings.Join(result.Changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %v, got %v", expected, result.Changes)
+	}
+	if !result.ReloadRequired {
+		t.Error("removing a cluster should require a reload")
+	}
+
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), "frontend stats") {
+		t.Error("stats frontend should be preserved")
+	}
+}
+
+func TestReconcileSlotChurnAvoidsReload(t *testing.T) {
+	client, _ := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyDual)
+
+	_, err := reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+
+	clusters := testClusters()
+	clusters[0].Ports[0].Targets = []string{"192.168.88.5", "fd00::2"}
+	result, err := reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if result.ReloadRequired {
+		t.Errorf("target churn should not require a reload, got %v", result.Changes)
+	}
+	expected := []serverUpdate{
+		{Backend: "a.example.com-6443", Server: "slot1", Address: "192.168.88.5", Port: 6443, Ready: true},
+	}
+	if !reflect.DeepEqual(result.ServerUpdates, expected) {
+		t.Errorf("expected %v, got %v", expected, result.ServerUpdates)
+	}
+
+	clusters[0].Ports[0].Targets = []string{"fd00::2"}
+	result, err = reconcile(client, buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	expected = []serverUpdate{
+		{Backend: "a.example.com-6443", Server: "slot1", Address: emptySlotAddress, Port: 6443},
+	}
+	if result.ReloadRequired || !reflect.DeepEqual(result.ServerUpdates, expected) {
+		t.Errorf("expected %v without reload, got %v", expected, result.ServerUpdates)
+	}
+}
+
+func TestReconcileRollsBackOnFailure(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	before, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Haproxy = "/bin/false"
+	_, err = reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err == nil {
+		t.Fatal("expected the failed configuration check to fail the reconcile")
+	}
+
+	after, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Errorf("configuration file was modified by a failed reconcile:\n%s", after)
+	}
+	maps, err := os.ReadDir(monitorConfig.MapDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(maps) != 0 {
+		t.Errorf("expected maps written by a failed reconcile to be removed, found %d", len(maps))
+	}
+}
+
+func TestReconcileRetriesVersionConflict(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+
+	other := &configuration.Client{}
+	err := other.Init(client.ClientParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := other.GetVersion("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.CreateBackend(&models.Backend{Name: "other", Mode: models.BackendModeTCP}, "", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) == 0 {
+		t.Error("expected changes after retrying")
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), "backend a.example.com-6443") {
+		t.Errorf("expected reconciled backends in configuration:\n%s", raw)
+	}
+}
@@ -0,0 +1,208 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/haproxytech/client-native/configuration"
+	"github.com/haproxytech/client-native/runtime"
+	"github.com/pkg/errors"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ReloadMasterCLI = "master-cli"
+	ReloadSignal    = "signal"
+	ReloadCommand   = "command"
+
+	// DefaultReloadTimeout is how long, in milliseconds, to wait for the
+	// reloaded HAProxy to answer on the stats socket.
+	DefaultReloadTimeout = 10000
+
+	reloadPollInterval = 250 * time.Millisecond
+)
+
+func validateReloadConfig(reload *data.ReloadConfig) error {
+	switch reload.Method {
+	case "":
+	case ReloadMasterCLI:
+		if len(reload.MasterSocket) == 0 {
+			return errors.Errorf("reload method %s requires master-socket", reload.Method)
+		}
+	case ReloadSignal:
+		if len(reload.PidFile) == 0 {
+			return errors.Errorf("reload method %s requires pid-file", reload.Method)
+		}
+	case ReloadCommand:
+		if len(reload.Command) == 0 {
+			return errors.Errorf("reload method %s requires command", reload.Method)
+		}
+	default:
+		return errors.Errorf("unknown reload method %s", reload.Method)
+	}
+	return nil
+}
+
+// validateConfiguration runs haproxy -c against configFiles, loaded in
+// order as HAProxy would load them.
+func validateConfiguration(haproxy string, configFiles ...string) error {
+	if len(haproxy) == 0 {
+		haproxy = configuration.DefaultHaproxy
+	}
+	args := []string{"-c"}
+	for _, configFile := range configFiles {
+		args = append(args, "-f", configFile)
+	}
+	output, err := exec.Command(haproxy, args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s is not valid: %s", strings.Join(configFiles, ", "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// restoreConfiguration puts back the configuration that was in place before
+// the run when the new one fails validation. A nil previous removes a
+// configuration file the run created.
+func restoreConfiguration(configFile string, previous []byte) error {
+	if previous == nil {
+		return os.Remove(configFile)
+	}
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(configFile, previous, info.Mode())
+}
+
+// reloadHaproxy triggers a reload using the configured method and waits for a
+// new HAProxy process to answer on the stats socket.
+func reloadHaproxy(reload *data.ReloadConfig, statsSocket string) error {
+	client, err := newRuntimeClient(statsSocket)
+	if err != nil {
+		return err
+	}
+	previousPid, _ := servingPid(client)
+
+	switch reload.Method {
+	case ReloadMasterCLI:
+		err = reloadMasterCLI(reload.MasterSocket)
+	case ReloadSignal:
+		err = reloadSignal(reload.PidFile)
+	case ReloadCommand:
+		err = reloadCommand(reload.Command)
+	default:
+		return errors.Errorf("unknown reload method %s", reload.Method)
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to reload haproxy")
+	}
+
+	timeout := reload.Timeout
+	if timeout <= 0 {
+		timeout = DefaultReloadTimeout
+	}
+	return waitForReload(client, previousPid, time.Duration(timeout)*time.Millisecond)
+}
+
+// reloadMasterCLI sends reload to the master CLI of an HAProxy running in
+// master-worker mode.
+func reloadMasterCLI(masterSocket string) error {
+	conn, err := net.DialTimeout("unix", masterSocket, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("reload\n"))
+	if err != nil {
+		return err
+	}
+	// The master answers once the reload has been dispatched; its output, if
+	// any, is only of interest for the log.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	if reply = strings.TrimSpace(reply); len(reply) > 0 {
+		logrus.Debugf("master cli: %s", reply)
+	}
+	return nil
+}
+
+// reloadSignal sends SIGUSR2 to the HAProxy master whose pid is in pidFile.
+func reloadSignal(pidFile string) error {
+	raw, err := os.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) == 0 {
+		return errors.Errorf("%s is empty", pidFile)
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return errors.Wrapf(err, "invalid pid in %s", pidFile)
+	}
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
+
+func reloadCommand(command string) error {
+	output, err := exec.Command("/bin/sh", "-c", command).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s failed: %s", command, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// servingPid returns the pid HAProxy reports on the stats socket. GetInfo
+// does not read the pid from every HAProxy version's typed output, so the
+// plain show info output is consulted when it comes back empty.
+func servingPid(client *runtime.Client) (int64, error) {
+	info, err := client.GetInfo()
+	if err != nil {
+		return 0, err
+	}
+	if len(info) > 0 && info[0].Pid != nil {
+		return *info[0].Pid, nil
+	}
+	raw, err := client.ExecuteRaw("show info")
+	if err != nil {
+		return 0, err
+	}
+	for _, output := range raw {
+		for _, line := range strings.Split(output, "\n") {
+			value := strings.TrimPrefix(line, "Pid:")
+			if value == line {
+				continue
+			}
+			return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no pid reported on the stats socket")
+}
+
+// waitForReload polls the stats socket until a process other than
+// previousPid answers, or any process answers if the previous one was
+// unknown.
+func waitForReload(client *runtime.Client, previousPid int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		pid, err := servingPid(client)
+		if err == nil && pid != previousPid {
+			logrus.Infof("haproxy reloaded, now serving from pid %d", pid)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("pid %d is still serving", pid)
+			}
+			return errors.Wrap(err, "reloaded haproxy did not come up")
+		}
+		time.Sleep(reloadPollInterval)
+	}
+}
@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func TestValidateReloadConfig(t *testing.T) {
+	valid := []data.ReloadConfig{
+		{},
+		{Method: ReloadMasterCLI, MasterSocket: "/var/run/haproxy-master.sock"},
+		{Method: ReloadSignal, PidFile: "/run/haproxy.pid"},
+		{Method: ReloadCommand, Command: "systemctl reload haproxy"},
+	}
+	for _, reload := range valid {
+		if err := validateReloadConfig(&reload); err != nil {
+			t.Errorf("%+v: %s", reload, err)
+		}
+	}
+	invalid := []data.ReloadConfig{
+		{Method: "restart"},
+		{Method: ReloadMasterCLI},
+		{Method: ReloadSignal},
+		{Method: ReloadCommand},
+	}
+	for _, reload := range invalid {
+		if err := validateReloadConfig(&reload); err == nil {
+			t.Errorf("%+v: expected an error", reload)
+		}
+	}
+}
+
+func TestValidateConfigurationRestoresPrevious(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "haproxy.cfg")
+	if err := os.WriteFile(configFile, []byte("broken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfiguration("/bin/false", configFile); err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	if err := validateConfiguration("/bin/true", configFile); err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+
+	if err := restoreConfiguration(configFile, []byte("previous\n")); err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "previous\n" {
+		t.Errorf("expected previous configuration, got %q", raw)
+	}
+}
+
+// pidAfterReload answers show info with pid 100 until marker exists and with
+// pid 200 afterwards, as a reloaded HAProxy would.
+func pidAfterReload(marker string) func(string) string {
+	return func(command string) string {
+		pid := 100
+		if _, err := os.Stat(marker); err == nil {
+			pid = 200
+		}
+		return fmt.Sprintf("Name: HAProxy\nPid: %d\n", pid)
+	}
+}
+
+func TestReloadHaproxyWaitsForNewProcess(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "reloaded")
+	socket := newFakeStatsSocket(t, pidAfterReload(marker))
+
+	reload := &data.ReloadConfig{
+		Method:  ReloadCommand,
+		Command: fmt.Sprintf("touch %s", marker),
+		Timeout: 2000,
+	}
+	if err := reloadHaproxy(reload, socket.path); err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+}
+
+func TestReloadHaproxyTimesOut(t *testing.T) {
+	socket := newFakeStatsSocket(t, pidAfterReload(filepath.Join(t.TempDir(), "never")))
+
+	reload := &data.ReloadConfig{
+		Method:  ReloadCommand,
+		Command: "true",
+		Timeout: 500,
+	}
+	if err := reloadHaproxy(reload, socket.path); err == nil {
+		t.Fatal("expected the reload to time out while the old process is serving")
+	}
+}
+
+func TestValidateConfigurationLoadsEveryFile(t *testing.T) {
+	dir := t.TempDir()
+	haproxy := filepath.Join(dir, "haproxy")
+	script := "#!/bin/sh\n[ \"$*\" = \"-c -f haproxy.cfg -f conf.d/dyna.cfg\" ]\n"
+	if err := os.WriteFile(haproxy, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfiguration(haproxy, "haproxy.cfg", "conf.d/dyna.cfg"); err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if err := validateConfiguration(haproxy, "haproxy.cfg"); err == nil {
+		t.Error("expected validation without the include to fail")
+	}
+
+	include := filepath.Join(dir, "dyna.cfg")
+	if err := os.WriteFile(include, []byte("broken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreConfiguration(include, nil); err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if _, err := os.Stat(include); !os.IsNotExist(err) {
+		t.Errorf("expected an include created by the run to be removed, got %v", err)
+	}
+}
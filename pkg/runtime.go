@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/haproxytech/client-native/runtime"
+	"github.com/haproxytech/models"
+)
+
+const (
+	// DefaultServerSlots is the size of the server pool each backend is
+	// rendered with unless server-slots is set.
+	DefaultServerSlots = 10
+
+	serverSlotPrefix = "slot"
+
+	// emptySlotAddress is parked in every unused slot so the server line
+	// stays valid while the slot is in maintenance.
+	emptySlotAddress = "127.0.0.1"
+)
+
+// defaultServerWeight is what HAProxy uses for servers without a weight.
+var defaultServerWeight = int64(1)
+
+// serverUpdate is a change to a single server slot that can be applied
+// through the runtime API without reloading HAProxy.
+type serverUpdate struct {
+	Backend string
+	Server  string
+	Address string
+	Port    int64
+	Ready   bool
+
+	// Weight is set before the slot is enabled, or nil to keep the current
+	// weight.
+	Weight *int64
+}
+
+func fillSlot(server *models.Server, address string, port int64) {
+	server.Address = address
+	server.Port = &port
+	server.Maintenance = ""
+}
+
+func emptySlot(server *models.Server, port int64) {
+	server.Address = emptySlotAddress
+	server.Port = &port
+	server.Maintenance = models.ServerMaintenanceEnabled
+}
+
+func slotFilled(server *models.Server) bool {
+	return server.Maintenance != models.ServerMaintenanceEnabled
+}
+
+func slotKey(server *models.Server) string {
+	port := int64(0)
+	if server.Port != nil {
+		port = *server.Port
+	}
+	return fmt.Sprintf("%s:%d", server.Address, port)
+}
+
+// stabilizeSlots reassigns the targets in desired so every target already
+// held by a slot in current keeps that slot. New targets take the free slots
+// in order. Without this, a target leaving the middle of the sorted list
+// would shift every later target into a different slot.
+func stabilizeSlots(desired models.Servers, current models.Servers) models.Servers {
+	slotIndex := map[string]int{}
+	for idx, server := range desired {
+		slotIndex[server.Name] = idx
+	}
+	targets := map[string]*models.Server{}
+	pending := []*models.Server{}
+	empty := []*models.Server{}
+	for _, server := range desired {
+		if slotFilled(server) {
+			targets[slotKey(server)] = server
+			pending = append(pending, server)
+		} else {
+			empty = append(empty, server)
+		}
+	}
+
+	assigned := make([]*models.Server, len(desired))
+	kept := map[string]bool{}
+	for _, server := range current {
+		idx, ok := slotIndex[server.Name]
+		if !ok || !slotFilled(server) {
+			continue
+		}
+		target, ok := targets[slotKey(server)]
+		if !ok || kept[slotKey(server)] {
+			continue
+		}
+		assigned[idx] = target
+		kept[slotKey(server)] = true
+	}
+
+	stable := make(models.Servers, len(desired))
+	for idx, slot := range desired {
+		server := assigned[idx]
+		if server == nil {
+			for len(pending) > 0 && kept[slotKey(pending[0])] {
+				pending = pending[1:]
+			}
+			if len(pending) > 0 {
+				server = pending[0]
+				pending = pending[1:]
+			} else {
+				server = empty[0]
+				empty = empty[1:]
+			}
+		}
+		filled := *server
+		filled.Name = slot.Name
+		stable[idx] = &filled
+	}
+	return stable
+}
+
+// runtimeUpdate returns the runtime API update that turns current into
+// desired, or false if the servers differ in anything other than the target
+// address, weight and maintenance state and a reload is required.
+func runtimeUpdate(backend string, desired *models.Server, current *models.Server) (serverUpdate, bool) {
+	patched := *current
+	patched.Address = desired.Address
+	patched.Port = desired.Port
+	patched.Maintenance = desired.Maintenance
+	patched.Weight = desired.Weight
+	if !reflect.DeepEqual(&patched, desired) {
+		return serverUpdate{}, false
+	}
+	port := int64(0)
+	if desired.Port != nil {
+		port = *desired.Port
+	}
+	var weight *int64
+	if !reflect.DeepEqual(current.Weight, desired.Weight) {
+		weight = desired.Weight
+		if weight == nil {
+			weight = &defaultServerWeight
+		}
+	}
+	return serverUpdate{
+		Backend: backend,
+		Server:  desired.Name,
+		Address: strings.Trim(desired.Address, "[]"),
+		Port:    port,
+		Ready:   slotFilled(desired),
+		Weight:  weight,
+	}, true
+}
+
+func newRuntimeClient(socketPath string) (*runtime.Client, error) {
+	if len(socketPath) == 0 {
+		socketPath = runtime.DefaultSocketPath
+	}
+	client := &runtime.Client{}
+	err := client.Init([]string{socketPath}, "", 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize runtime client: %w", err)
+	}
+	return client, nil
+}
+
+// applyServerUpdates points filled slots at their target and takes them out
+// of maintenance, and puts emptied slots back into maintenance.
+func applyServerUpdates(client *runtime.Client, updates []serverUpdate) error {
+	for _, update := range updates {
+		if update.Weight != nil {
+			err := client.SetServerWeight(update.Backend, update.Server, strconv.FormatInt(*update.Weight, 10))
+			if err != nil {
+				return fmt.Errorf("unable to set weight of %s/%s: %w", update.Backend, update.Server, err)
+			}
+		}
+		if !update.Ready {
+			err := client.SetServerState(update.Backend, update.Server, "maint")
+			if err != nil {
+				return fmt.Errorf("unable to drain %s/%s: %w", update.Backend, update.Server, err)
+			}
+			continue
+		}
+		err := client.SetServerAddr(update.Backend, update.Server, update.Address, int(update.Port))
+		if err != nil {
+			return fmt.Errorf("unable to set address of %s/%s: %w", update.Backend, update.Server, err)
+		}
+		err = client.SetServerState(update.Backend, update.Server, "ready")
+		if err != nil {
+			return fmt.Errorf("unable to enable %s/%s: %w", update.Backend, update.Server, err)
+		}
+	}
+	return nil
+}
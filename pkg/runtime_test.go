@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+// fakeStatsSocket answers runtime API commands on a unix socket with the
+// output of respond, or an empty response if respond is nil, and records the
+// commands it received.
+type fakeStatsSocket struct {
+	path     string
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeStatsSocket(t *testing.T, respond func(command string) string) *fakeStatsSocket {
+	socket := &fakeStatsSocket{path: filepath.Join(t.TempDir(), "haproxy.sock")}
+	listener, err := net.Listen("unix", socket.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			line = strings.TrimPrefix(strings.TrimSpace(line), "set severity-output number;")
+			socket.mu.Lock()
+			socket.commands = append(socket.commands, line)
+			socket.mu.Unlock()
+			response := "\n"
+			if respond != nil {
+				response = respond(line)
+			}
+			conn.Write([]byte(response))
+			conn.Close()
+		}
+	}()
+	return socket
+}
+
+func (s *fakeStatsSocket) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func TestApplyServerUpdates(t *testing.T) {
+	socket := newFakeStatsSocket(t, nil)
+	client, err := newRuntimeClient(socket.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weight := int64(20)
+	err = applyServerUpdates(client, []serverUpdate{
+		{Backend: "a.example.com-6443", Server: "slot1", Address: "fd00::2", Port: 6443, Ready: true, Weight: &weight},
+		{Backend: "a.example.com-6443", Server: "slot2", Address: emptySlotAddress, Port: 6443},
+	})
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	expected := []string{
+		"set server a.example.com-6443/slot1 weight 20",
+		"set server a.example.com-6443/slot1 addr fd00::2 port 6443",
+		"set server a.example.com-6443/slot1 state ready",
+		"set server a.example.com-6443/slot2 state maint",
+	}
+	if commands := socket.received(); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %v, got %v", expected, commands)
+	}
+}
+
+func TestBuildBackendGrowsSlotPool(t *testing.T) {
+	port := &data.MonitorPort{Port: 6443, Targets: []string{"192.168.88.2", "192.168.88.3", "192.168.88.4"}}
+	backend := buildBackend("a.example.com-6443", port, 2)
+	if len(backend.Servers) != 4 {
+		t.Fatalf("expected 4 slots, got %d", len(backend.Servers))
+	}
+	for idx, server := range backend.Servers {
+		if filled := idx < len(port.Targets); slotFilled(server) != filled {
+			t.Errorf("slot %s: expected filled=%t", server.Name, filled)
+		}
+	}
+}
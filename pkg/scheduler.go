@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	DefaultMaxConcurrency = 100
+)
+
+// probeScheduler bounds the number of probes in flight across all ranges.
+// A slot is handed to the next probe as soon as any running probe finishes,
+// so a single slow target does not hold up the rest of the scan.
+type probeScheduler struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newProbeScheduler(maxConcurrency int) *probeScheduler {
+	if maxConcurrency <= 0 {
+		maxConcurrency = DefaultMaxConcurrency
+	}
+	return &probeScheduler{
+		slots: make(chan struct{}, maxConcurrency),
+	}
+}
+
+// newRangeSlots returns the per-range limit passed to schedule, or nil if the
+// range is only bounded by the global limit.
+func newRangeSlots(maxConcurrency int) chan struct{} {
+	if maxConcurrency <= 0 {
+		return nil
+	}
+	return make(chan struct{}, maxConcurrency)
+}
+
+// schedule blocks until a slot is free in both rangeSlots and the global pool
+// and then runs probe in its own goroutine. It returns false without running
+// probe if ctx is done first.
+func (s *probeScheduler) schedule(ctx context.Context, rangeSlots chan struct{}, probe func()) bool {
+	if rangeSlots != nil {
+		select {
+		case rangeSlots <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		if rangeSlots != nil {
+			<-rangeSlots
+		}
+		return false
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			<-s.slots
+			if rangeSlots != nil {
+				<-rangeSlots
+			}
+			s.wg.Done()
+		}()
+		probe()
+	}()
+	return true
+}
+
+// wait blocks until every scheduled probe has returned.
+func (s *probeScheduler) wait() {
+	s.wg.Wait()
+}
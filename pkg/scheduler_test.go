@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeSchedulerLimits(t *testing.T) {
+	const globalLimit = 4
+	const rangeLimit = 2
+
+	scheduler := newProbeScheduler(globalLimit)
+	var inFlight, maxInFlight int32
+	var rangeInFlight [3]int32
+	var rangeMax [3]int32
+
+	var wg sync.WaitGroup
+	for r := 0; r < 3; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			rangeSlots := newRangeSlots(rangeLimit)
+			for i := 0; i < 20; i++ {
+				scheduler.schedule(context.Background(), rangeSlots, func() {
+					n := atomic.AddInt32(&inFlight, 1)
+					rn := atomic.AddInt32(&rangeInFlight[r], 1)
+					for {
+						m := atomic.LoadInt32(&maxInFlight)
+						if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+							break
+						}
+					}
+					for {
+						m := atomic.LoadInt32(&rangeMax[r])
+						if rn <= m || atomic.CompareAndSwapInt32(&rangeMax[r], m, rn) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond)
+					atomic.AddInt32(&rangeInFlight[r], -1)
+					atomic.AddInt32(&inFlight, -1)
+				})
+			}
+		}(r)
+	}
+	wg.Wait()
+	scheduler.wait()
+
+	if maxInFlight > globalLimit {
+		t.Errorf("expected at most %d probes in flight, saw %d", globalLimit, maxInFlight)
+	}
+	for r, m := range rangeMax {
+		if m > rangeLimit {
+			t.Errorf("expected at most %d probes in flight for range %d, saw %d", rangeLimit, r, m)
+		}
+	}
+}
+
+func TestProbeSchedulerCancel(t *testing.T) {
+	scheduler := newProbeScheduler(1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	release := make(chan struct{})
+	if !scheduler.schedule(ctx, nil, func() { <-release }) {
+		t.Fatal("expected first probe to be scheduled")
+	}
+	cancel()
+	if scheduler.schedule(ctx, nil, func() { t.Error("probe ran after cancel") }) {
+		t.Error("expected schedule to fail after cancel")
+	}
+	close(release)
+	scheduler.wait()
+}
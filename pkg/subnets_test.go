@@ -7,7 +7,7 @@ import (
 )
 
 func TestAbs(t *testing.T) {
-	monitorRanges, err := parseSubnetsJson()
+	monitorRanges, err := parseSubnetsJson("testdata/subnets.json")
 
 	if err != nil {
 		t.Errorf("failed: %s", err)
@@ -0,0 +1,234 @@
+package pkg
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+	"github.com/sirupsen/logrus"
+)
+
+// outputTarget is an output target with its settings resolved against the
+// top-level monitor config.
+type outputTarget struct {
+	Name          string
+	MonitorConfig *data.MonitorConfig
+	filter        *clusterFilter
+	listenPorts   map[int64]int64
+}
+
+// clusterFilter is the compiled form of a data.TargetFilter.
+type clusterFilter struct {
+	domains []*regexp.Regexp
+	ranges  map[string]bool
+	ports   map[int64]bool
+}
+
+func newClusterFilter(filter *data.TargetFilter) (*clusterFilter, error) {
+	compiled := &clusterFilter{ranges: map[string]bool{}, ports: map[int64]bool{}}
+	for _, domain := range filter.Domains {
+		pattern, err := regexp.Compile(domain)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid domain filter %q", domain)
+		}
+		compiled.domains = append(compiled.domains, pattern)
+	}
+	for _, name := range filter.Ranges {
+		compiled.ranges[name] = true
+	}
+	for _, port := range filter.Ports {
+		compiled.ports[port] = true
+	}
+	return compiled, nil
+}
+
+func (f *clusterFilter) acceptsDomain(baseDomain string) bool {
+	if len(f.domains) == 0 {
+		return true
+	}
+	for _, pattern := range f.domains {
+		if pattern.MatchString(baseDomain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *clusterFilter) acceptsRange(monitorRange *data.MonitorRange) bool {
+	return len(f.ranges) == 0 || f.ranges[monitorRange.Name]
+}
+
+func (f *clusterFilter) acceptsPort(port int64) bool {
+	return len(f.ports) == 0 || f.ports[port]
+}
+
+// resolveTargets returns the output targets of monitorConfig. Without any, a
+// single unnamed target serves every cluster with the top-level settings.
+// Command line overrides apply to every target, over its own settings.
+func resolveTargets(monitorConfig *data.MonitorConfig) ([]*outputTarget, error) {
+	if len(monitorConfig.Targets) == 0 {
+		filter, _ := newClusterFilter(&data.TargetFilter{})
+		return []*outputTarget{{MonitorConfig: monitorConfig, filter: filter}}, nil
+	}
+	targets := []*outputTarget{}
+	for idx := range monitorConfig.Targets {
+		target := &monitorConfig.Targets[idx]
+		config := *monitorConfig
+		config.Targets = nil
+		if target.Output != (data.OutputConfig{}) {
+			config.Output = target.Output
+		}
+		if target.Client != (data.ClientConfig{}) {
+			config.Client = target.Client
+		}
+		if target.Reload != (data.ReloadConfig{}) {
+			config.Reload = target.Reload
+		}
+		if len(target.StatsSocket) > 0 {
+			config.StatsSocket = target.StatsSocket
+		}
+		if len(target.MapDir) > 0 {
+			config.MapDir = target.MapDir
+		}
+		Overrides.apply(&config)
+		filter, err := newClusterFilter(&target.Filter)
+		if err != nil {
+			return nil, errors.Wrapf(err, "target %s", target.Name)
+		}
+		listenPorts := map[int64]int64{}
+		for _, mapping := range target.PortMappings {
+			listenPorts[mapping.Port] = mapping.ListenPort
+		}
+		targets = append(targets, &outputTarget{
+			Name:          target.Name,
+			MonitorConfig: &config,
+			filter:        filter,
+			listenPorts:   listenPorts,
+		})
+	}
+	return targets, nil
+}
+
+// destination identifies what a target writes, so two targets never write
+// the same configuration.
+func (t *outputTarget) destination() string {
+	output := &t.MonitorConfig.Output
+	switch output.Type {
+	case OutputDataplane:
+		return output.URL
+	case OutputTemplate:
+		if len(output.File) > 0 {
+			return output.File
+		}
+		return DefaultIncludeFile
+	}
+	return clientParams(&t.MonitorConfig.Client).ConfigurationFile
+}
+
+func (t *outputTarget) log() *logrus.Entry {
+	if len(t.Name) == 0 {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return logrus.WithField("target", t.Name)
+}
+
+func validPort(port int64) bool {
+	return port > 0 && port <= 65535
+}
+
+// validateTargets checks every output target with its resolved settings.
+func validateTargets(monitorConfig *data.MonitorConfig) error {
+	if len(monitorConfig.Targets) == 0 {
+		return nil
+	}
+	targets, err := resolveTargets(monitorConfig)
+	if err != nil {
+		return err
+	}
+	rangeNames := map[string]bool{}
+	for _, monitorRange := range monitorConfig.MonitorRanges {
+		rangeNames[monitorRange.Name] = true
+	}
+	names := map[string]bool{}
+	destinations := map[string]string{}
+	mapDirs := map[string]string{}
+	for idx, target := range targets {
+		if len(target.Name) == 0 {
+			return errors.Errorf("target %d has no name", idx+1)
+		}
+		if names[target.Name] {
+			return errors.Errorf("duplicate target %s", target.Name)
+		}
+		names[target.Name] = true
+		own := &monitorConfig.Targets[idx]
+		if own.Client != (data.ClientConfig{}) && (own.Reload == (data.ReloadConfig{}) || len(own.StatsSocket) == 0) {
+			return errors.Errorf("target %s sets client and requires its own reload and stats-socket", target.Name)
+		}
+		if err := validateReloadConfig(&target.MonitorConfig.Reload); err != nil {
+			return errors.Wrapf(err, "target %s", target.Name)
+		}
+		if err := validateOutput(&target.MonitorConfig.Output, target.MonitorConfig); err != nil {
+			return errors.Wrapf(err, "target %s", target.Name)
+		}
+		for _, name := range monitorConfig.Targets[idx].Filter.Ranges {
+			if !rangeNames[name] {
+				return errors.Errorf("target %s filters on unknown range %s", target.Name, name)
+			}
+		}
+		for _, mapping := range monitorConfig.Targets[idx].PortMappings {
+			if !validPort(mapping.Port) || !validPort(mapping.ListenPort) {
+				return errors.Errorf("invalid port mapping %d:%d for target %s", mapping.Port, mapping.ListenPort, target.Name)
+			}
+		}
+
+		destination := target.destination()
+		if other, ok := destinations[destination]; ok {
+			return errors.Errorf("targets %s and %s both write %s", other, target.Name, destination)
+		}
+		destinations[destination] = target.Name
+		if target.MonitorConfig.Output.Type == OutputDataplane {
+			continue
+		}
+		mapDir := target.MonitorConfig.MapDir
+		if len(mapDir) == 0 {
+			mapDir = DefaultMapDir
+		}
+		if other, ok := mapDirs[mapDir]; ok {
+			return errors.Errorf("targets %s and %s both write maps to %s", other, target.Name, mapDir)
+		}
+		mapDirs[mapDir] = target.Name
+	}
+	return nil
+}
+
+// clusters returns the clusters found in monitorRanges that target accepts,
+// merged by base domain, with its port mappings applied.
+func (t *outputTarget) clusters(monitorRanges []data.MonitorRange) []data.Cluster {
+	accepted := []data.Cluster{}
+	for idx := range monitorRanges {
+		if !t.filter.acceptsRange(&monitorRanges[idx]) {
+			continue
+		}
+		for _, cluster := range groupClusters(&monitorRanges[idx]) {
+			if !t.filter.acceptsDomain(cluster.BaseDomain) {
+				continue
+			}
+			ports := []data.MonitorPort{}
+			for _, monitorPort := range cluster.Ports {
+				if !t.filter.acceptsPort(monitorPort.Port) {
+					continue
+				}
+				if listenPort, ok := t.listenPorts[monitorPort.Port]; ok {
+					monitorPort.ListenPort = listenPort
+				}
+				ports = append(ports, monitorPort)
+			}
+			if len(ports) == 0 {
+				continue
+			}
+			cluster.Ports = ports
+			accepted = append(accepted, cluster)
+		}
+	}
+	return mergeClusters(accepted)
+}
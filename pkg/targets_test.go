@@ -0,0 +1,214 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func testTargetRanges() []data.MonitorRange {
+	return []data.MonitorRange{
+		{
+			Name: "lab",
+			MonitorPorts: []data.MonitorPort{
+				{
+					Port:          6443,
+					PathMatch:     "api",
+					Targets:       []string{"192.168.88.2"},
+					TargetDomains: map[string]string{"192.168.88.2": "lab.example.com"},
+				},
+			},
+		},
+		{
+			Name: "prod",
+			MonitorPorts: []data.MonitorPort{
+				{
+					Port:          6443,
+					PathMatch:     "api",
+					Targets:       []string{"10.0.0.2"},
+					TargetDomains: map[string]string{"10.0.0.2": "a.prod.example.com"},
+				},
+				{
+					Port:          443,
+					PathPrefix:    "*.apps",
+					Targets:       []string{"10.0.0.3"},
+					TargetDomains: map[string]string{"10.0.0.3": "a.prod.example.com"},
+				},
+			},
+		},
+	}
+}
+
+func TestTargetClusters(t *testing.T) {
+	monitorConfig := &data.MonitorConfig{
+		MonitorRanges: testTargetRanges(),
+		Targets: []data.OutputTarget{
+			{Name: "internal"},
+			{
+				Name:         "external",
+				Filter:       data.TargetFilter{Domains: []string{`\.prod\.example\.com$`}, Ports: []int64{443}},
+				PortMappings: []data.PortMapping{{Port: 443, ListenPort: 8443}},
+			},
+			{Name: "lab", Filter: data.TargetFilter{Ranges: []string{"lab"}}},
+		},
+	}
+	targets, err := resolveTargets(monitorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	domains := func(clusters []data.Cluster) []string {
+		result := []string{}
+		for _, cluster := range clusters {
+			result = append(result, cluster.BaseDomain)
+		}
+		return result
+	}
+	if got := domains(targets[0].clusters(monitorConfig.MonitorRanges)); !reflect.DeepEqual(got, []string{"a.prod.example.com", "lab.example.com"}) {
+		t.Errorf("expected the unfiltered target to see every cluster, got %v", got)
+	}
+	if got := domains(targets[2].clusters(monitorConfig.MonitorRanges)); !reflect.DeepEqual(got, []string{"lab.example.com"}) {
+		t.Errorf("expected the range filter to keep lab.example.com, got %v", got)
+	}
+
+	external := targets[1].clusters(monitorConfig.MonitorRanges)
+	expected := []data.Cluster{
+		{
+			BaseDomain: "a.prod.example.com",
+			Ports: []data.MonitorPort{
+				{Port: 443, PathPrefix: "*.apps", Targets: []string{"10.0.0.3"}, ListenPort: 8443},
+			},
+		},
+	}
+	if !reflect.DeepEqual(external, expected) {
+		t.Errorf("expected %+v, got %+v", expected, external)
+	}
+	if monitorConfig.MonitorRanges[1].MonitorPorts[1].ListenPort != 0 {
+		t.Error("expected port mappings to leave the monitor ranges untouched")
+	}
+}
+
+func TestResolveTargetsAppliesOverrides(t *testing.T) {
+	Overrides = PathOverrides{ConfigurationFile: "/srv/haproxy-test/haproxy.cfg", MasterSocket: "/srv/haproxy-test/master.sock"}
+	defer func() { Overrides = PathOverrides{} }()
+	monitorConfig := &data.MonitorConfig{
+		Targets: []data.OutputTarget{
+			{
+				Name:        "external",
+				Client:      data.ClientConfig{ConfigurationFile: "/etc/haproxy-external/haproxy.cfg", Haproxy: "/usr/sbin/haproxy"},
+				Reload:      data.ReloadConfig{Method: ReloadMasterCLI, MasterSocket: "/var/run/haproxy-external-master.sock"},
+				StatsSocket: "/var/run/haproxy-external.sock",
+			},
+		},
+	}
+	targets, err := resolveTargets(monitorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved := targets[0].MonitorConfig
+	if resolved.Client.ConfigurationFile != Overrides.ConfigurationFile || resolved.Reload.MasterSocket != Overrides.MasterSocket {
+		t.Errorf("expected the command line to take precedence, got %+v and %+v", resolved.Client, resolved.Reload)
+	}
+	if resolved.Client.Haproxy != "/usr/sbin/haproxy" || resolved.StatsSocket != "/var/run/haproxy-external.sock" {
+		t.Errorf("expected settings without a flag to be kept, got %+v", resolved)
+	}
+}
+
+func TestValidateTargets(t *testing.T) {
+	valid := &data.MonitorConfig{
+		MonitorRanges: testTargetRanges(),
+		Targets: []data.OutputTarget{
+			{Name: "internal"},
+			{
+				Name:   "external",
+				Output: data.OutputConfig{Type: OutputTemplate, File: "/etc/haproxy-external/conf.d/dyna.cfg"},
+				MapDir: "/etc/haproxy-external/maps",
+				Filter: data.TargetFilter{Domains: []string{`\.prod\.example\.com$`}, Ranges: []string{"prod"}},
+			},
+		},
+	}
+	if err := validateTargets(valid); err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+
+	other := func(update func(target *data.OutputTarget)) data.OutputTarget {
+		target := data.OutputTarget{
+			Name:        "other",
+			MapDir:      "/srv/maps",
+			Client:      data.ClientConfig{ConfigurationFile: "/srv/haproxy.cfg"},
+			Reload:      data.ReloadConfig{Method: ReloadMasterCLI, MasterSocket: "/srv/master.sock"},
+			StatsSocket: "/srv/stats.sock",
+		}
+		update(&target)
+		return target
+	}
+	invalid := map[string]data.OutputTarget{
+		"duplicate target": other(func(target *data.OutputTarget) { target.Name = "internal" }),
+		"unknown range":    other(func(target *data.OutputTarget) { target.Filter.Ranges = []string{"staging"} }),
+		"invalid domain":   other(func(target *data.OutputTarget) { target.Filter.Domains = []string{"(prod"} }),
+		"invalid port": other(func(target *data.OutputTarget) {
+			target.PortMappings = []data.PortMapping{{Port: 443, ListenPort: 70000}}
+		}),
+		"both write":      other(func(target *data.OutputTarget) { target.Client = data.ClientConfig{} }),
+		"both write maps": other(func(target *data.OutputTarget) { target.MapDir = "" }),
+		"unknown output":  other(func(target *data.OutputTarget) { target.Output.Type = "nginx" }),
+		"requires its own reload and stats-socket": other(func(target *data.OutputTarget) {
+			target.Reload = data.ReloadConfig{}
+		}),
+		"sets client and requires": other(func(target *data.OutputTarget) { target.StatsSocket = "" }),
+	}
+	for expected, target := range invalid {
+		monitorConfig := *valid
+		monitorConfig.Targets = append(append([]data.OutputTarget{}, valid.Targets...), target)
+		err := validateTargets(&monitorConfig)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error containing %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestApplyConfigurationTargets(t *testing.T) {
+	dir := t.TempDir()
+	target := func(name string) data.OutputTarget {
+		return data.OutputTarget{
+			Name:   name,
+			Output: data.OutputConfig{Type: OutputTemplate, File: filepath.Join(dir, name, "dyna.cfg")},
+			MapDir: filepath.Join(dir, name, "maps"),
+		}
+	}
+	external := target("external")
+	external.Filter.Domains = []string{`\.prod\.example\.com$`}
+	spec := &data.MonitorConfigSpec{
+		MonitorConfig: data.MonitorConfig{
+			MonitorRanges: testTargetRanges(),
+			ServerSlots:   1,
+			Targets:       []data.OutputTarget{target("internal"), external},
+		},
+	}
+
+	reloadRequired, err := ApplyConfiguration(spec)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if !reloadRequired {
+		t.Error("expected new include files to require a reload")
+	}
+	internalMap, err := os.ReadFile(filepath.Join(dir, "internal", "maps", "dyna-frontend-16443.exact.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(internalMap) != "api.a.prod.example.com a.prod.example.com-6443\napi.lab.example.com lab.example.com-6443\n" {
+		t.Errorf("unexpected internal map:\n%s", internalMap)
+	}
+	externalInclude, err := os.ReadFile(external.Output.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(externalInclude), "lab.example.com") || !strings.Contains(string(externalInclude), "backend a.prod.example.com-443") {
+		t.Errorf("expected only the prod cluster in the external include:\n%s", externalInclude)
+	}
+}
@@ -0,0 +1,396 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/haproxytech/config-parser/params"
+	"github.com/haproxytech/models"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+const (
+	// DefaultIncludeFile is the file the template output writes unless
+	// output.file is set. HAProxy loads it when started with the directory
+	// as an extra -f argument.
+	DefaultIncludeFile = "/etc/haproxy/conf.d/dyna.cfg"
+
+	// defaultTemplate renders every frontend and backend of the snapshot
+	// with the same directives the client-native output writes.
+	defaultTemplate = `# {{ .Marker }}
+# Generated from the discovered clusters, changes are overwritten.
+{{- range .Frontends }}
+
+frontend {{ .Name }}
+  mode {{ .Mode }}
+{{- range .Binds }}
+  bind {{ . }}
+{{- end }}
+{{- range .Rules }}
+  {{ . }}
+{{- end }}
+{{- range .UseBackends }}
+  use_backend {{ . }}
+{{- end }}
+{{- if .DefaultBackend }}
+  default_backend {{ .DefaultBackend }}
+{{- end }}
+{{- end }}
+{{- range .Backends }}
+
+backend {{ .Name }}
+  mode {{ .Mode }}
+{{- range .Options }}
+  {{ . }}
+{{- end }}
+{{- range .Servers }}
+  server {{ . }}
+{{- end }}
+{{- end }}
+`
+)
+
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// templateSnapshot is the data a template is executed with. Frontends and
+// Backends carry ready-made configuration lines, Clusters the discovery
+// result they were built from for templates that render their own.
+type templateSnapshot struct {
+	Marker    string
+	Clusters  []data.Cluster
+	Frontends []templateFrontend
+	Backends  []templateBackend
+}
+
+type templateFrontend struct {
+	Name           string
+	Mode           string
+	Binds          []string
+	Rules          []string
+	UseBackends    []string
+	DefaultBackend string
+	MapPath        string
+	ExactMapPath   string
+	MapEntries     []mapEntry
+}
+
+type templateBackend struct {
+	Name    string
+	Mode    string
+	Options []string
+	Servers []string
+}
+
+// loadTemplate parses the template at path, or the built-in template when
+// path is empty.
+func loadTemplate(path string) (*template.Template, error) {
+	name, text := "default", defaultTemplate
+	if len(path) > 0 {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read template: %w", err)
+		}
+		name, text = filepath.Base(path), string(raw)
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// templateOutput renders the whole managed configuration into an include
+// file loaded after haproxy.cfg, which is never touched. The SNI maps are
+// kept in their own files as with the client-native output so map changes
+// can still be applied through the runtime API.
+type templateOutput struct {
+	file     string
+	mainFile string
+	template *template.Template
+}
+
+func newTemplateOutput(config *data.OutputConfig, mainFile string) (*templateOutput, error) {
+	tmpl, err := loadTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+	file := config.File
+	if len(file) == 0 {
+		file = DefaultIncludeFile
+	}
+	return &templateOutput{file: file, mainFile: mainFile, template: tmpl}, nil
+}
+
+func (o *templateOutput) render(desired *haproxyModel) ([]byte, error) {
+	var buf bytes.Buffer
+	err := o.template.Execute(&buf, newTemplateSnapshot(desired))
+	if err != nil {
+		return nil, fmt.Errorf("unable to render template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// sync renders desired and brings the maps it references in line with it
+// through r, removing the maps only the previous include file referenced.
+// It returns the include file on disk, nil if there is none, and its new
+// content.
+func (o *templateOutput) sync(desired *haproxyModel, r *reconciler) ([]byte, []byte, error) {
+	content, err := o.render(desired)
+	if err != nil {
+		return nil, nil, err
+	}
+	previous, err := os.ReadFile(o.file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("unable to read %s: %w", o.file, err)
+	}
+
+	desiredMaps := map[string]bool{}
+	for _, frontend := range desired.Frontends {
+		if frontend.SNIMap == nil {
+			continue
+		}
+		for _, file := range frontend.SNIMap.files() {
+			desiredMaps[file.Path] = true
+			err = r.syncMap(file)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	for _, match := range mapRulePattern.FindAllStringSubmatch(string(previous), -1) {
+		if desiredMaps[match[1]] {
+			continue
+		}
+		desiredMaps[match[1]] = true
+		err = r.removeMap(match[1])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !bytes.Equal(previous, content) {
+		r.record("write %s", o.file)
+	}
+	return previous, content, nil
+}
+
+func (o *templateOutput) apply(desired *haproxyModel) (*reconcileResult, error) {
+	r := &reconciler{ownership: desired.Ownership, mapBackups: map[string][]byte{}}
+	previous, content, err := o.sync(desired, r)
+	if err == nil && !bytes.Equal(previous, content) {
+		err = os.MkdirAll(filepath.Dir(o.file), 0755)
+		if err == nil {
+			err = os.WriteFile(o.file, content, 0644)
+		}
+		if err != nil {
+			err = fmt.Errorf("unable to write %s: %w", o.file, err)
+		}
+	}
+	if err != nil {
+		r.restoreMaps()
+		return nil, err
+	}
+	r.result.MapBackups = r.mapBackups
+	return &r.result, nil
+}
+
+func (o *templateOutput) plan(desired *haproxyModel, out io.Writer) (*reconcileResult, error) {
+	r := &reconciler{
+		ownership:   desired.Ownership,
+		mapBackups:  map[string][]byte{},
+		dryRun:      true,
+		mapContents: map[string][]byte{},
+	}
+	previous, content, err := o.sync(desired, r)
+	if err != nil {
+		return nil, err
+	}
+	fromName := o.file
+	if previous == nil {
+		fromName = "/dev/null"
+	}
+	_, err = writeUnifiedDiff(out, fromName, o.file, string(previous), string(content))
+	if err != nil {
+		return nil, err
+	}
+	err = writeMapDiffs(out, r)
+	if err != nil {
+		return nil, err
+	}
+	return &r.result, nil
+}
+
+func (o *templateOutput) configFile() string {
+	return o.file
+}
+
+func (o *templateOutput) checkFiles() []string {
+	return []string{o.mainFile, o.file}
+}
+
+func newTemplateSnapshot(desired *haproxyModel) templateSnapshot {
+	snapshot := templateSnapshot{
+		Marker:   desired.Ownership.marker(),
+		Clusters: desired.Clusters,
+	}
+	for _, frontend := range desired.Frontends {
+		snapshotFrontend := templateFrontend{
+			Name:           frontend.Frontend.Name,
+			Mode:           frontend.Frontend.Mode,
+			DefaultBackend: frontend.Frontend.DefaultBackend,
+		}
+		for _, bind := range frontend.Binds {
+			snapshotFrontend.Binds = append(snapshotFrontend.Binds, bindLine(bind))
+		}
+		for _, rule := range frontend.TCPRequestRules {
+			snapshotFrontend.Rules = append(snapshotFrontend.Rules, tcpRequestRuleLine(rule))
+		}
+		for _, rule := range frontend.SwitchingRules {
+			snapshotFrontend.UseBackends = append(snapshotFrontend.UseBackends, switchingRuleLine(rule))
+		}
+		if frontend.SNIMap != nil {
+			snapshotFrontend.MapPath = frontend.SNIMap.Path
+			snapshotFrontend.ExactMapPath = exactMapPath(frontend.SNIMap.Path)
+			snapshotFrontend.MapEntries = frontend.SNIMap.Entries
+		}
+		snapshot.Frontends = append(snapshot.Frontends, snapshotFrontend)
+	}
+	for _, backend := range desired.Backends {
+		snapshotBackend := templateBackend{
+			Name:    backend.Backend.Name,
+			Mode:    backend.Backend.Mode,
+			Options: backendOptionLines(backend),
+		}
+		for _, server := range backend.Servers {
+			snapshotBackend.Servers = append(snapshotBackend.Servers, serverLine(server, backend.ServerParams))
+		}
+		snapshot.Backends = append(snapshot.Backends, snapshotBackend)
+	}
+	return snapshot
+}
+
+// bindLine returns the arguments of the bind directive for bind.
+func bindLine(bind *models.Bind) string {
+	parts := []string{fmt.Sprintf("%s:%d", bind.Address, *bind.Port), "name", bind.Name}
+	if bind.V4v6 {
+		parts = append(parts, "v4v6")
+	}
+	if bind.Transparent {
+		parts = append(parts, "transparent")
+	}
+	if bind.AcceptProxy {
+		parts = append(parts, "accept-proxy")
+	}
+	if bind.TCPUserTimeout != nil {
+		parts = append(parts, "tcp-ut", fmt.Sprint(*bind.TCPUserTimeout))
+	}
+	if len(bind.Process) > 0 {
+		parts = append(parts, "process", bind.Process)
+	}
+	return strings.Join(parts, " ")
+}
+
+// switchingRuleLine returns the arguments of the use_backend directive for
+// rule.
+func switchingRuleLine(rule *models.BackendSwitchingRule) string {
+	if len(rule.Cond) == 0 {
+		return rule.Name
+	}
+	return strings.Join([]string{rule.Name, rule.Cond, rule.CondTest}, " ")
+}
+
+func tcpRequestRuleLine(rule *models.TCPRequestRule) string {
+	if rule.Type == models.TCPRequestRuleTypeInspectDelay {
+		return fmt.Sprintf("tcp-request inspect-delay %d", *rule.Timeout)
+	}
+	parts := []string{"tcp-request", rule.Type, rule.Action}
+	if len(rule.Cond) > 0 {
+		parts = append(parts, rule.Cond, rule.CondTest)
+	}
+	return strings.Join(parts, " ")
+}
+
+// backendOptionLines returns the balance, health check and persistence
+// directives of backend.
+func backendOptionLines(backend *backendModel) []string {
+	lines := []string{}
+	if balance := backend.Backend.Balance; balance != nil {
+		lines = append(lines, strings.Join(append([]string{"balance", balance.Algorithm}, balance.Arguments...), " "))
+	}
+	switch backend.Backend.AdvCheck {
+	case models.BackendAdvCheckTCPCheck:
+		lines = append(lines, "option tcp-check")
+	case models.BackendAdvCheckSslHelloChk:
+		lines = append(lines, "option ssl-hello-chk")
+	}
+	if httpchk := backend.Backend.Httpchk; httpchk != nil {
+		lines = append(lines, fmt.Sprintf("option httpchk %s %s", httpchk.Method, httpchk.URI))
+	}
+	if defaultServer := backend.Backend.DefaultServer; defaultServer != nil {
+		parts := []string{"default-server"}
+		for _, option := range []struct {
+			name  string
+			value *int64
+		}{
+			{"inter", defaultServer.Inter},
+			{"fall", defaultServer.Fall},
+			{"rise", defaultServer.Rise},
+			{"port", defaultServer.Port},
+		} {
+			if option.value != nil {
+				parts = append(parts, option.name, fmt.Sprint(*option.value))
+			}
+		}
+		lines = append(lines, strings.Join(parts, " "))
+	}
+	if table := backend.Backend.StickTable; table != nil {
+		parts := []string{"stick-table", "type", table.Type}
+		if table.Keylen != nil {
+			parts = append(parts, "len", fmt.Sprint(*table.Keylen))
+		}
+		parts = append(parts, "size", fmt.Sprint(*table.Size), "expire", fmt.Sprint(*table.Expire))
+		if len(table.Store) > 0 {
+			parts = append(parts, "store", table.Store)
+		}
+		lines = append(lines, strings.Join(parts, " "))
+	}
+	for _, rule := range backend.StickRules {
+		lines = append(lines, fmt.Sprintf("stick %s %s", rule.Type, rule.Pattern))
+	}
+	return lines
+}
+
+// serverLine returns the arguments of the server directive for server in the
+// order client-native writes them.
+func serverLine(server *models.Server, serverParams []params.ServerOption) string {
+	parts := []string{server.Name, fmt.Sprintf("%s:%d", server.Address, *server.Port)}
+	if server.Maintenance == models.ServerMaintenanceEnabled {
+		parts = append(parts, "disabled")
+	}
+	if server.Check == models.ServerCheckEnabled {
+		parts = append(parts, "check")
+	}
+	if server.Weight != nil {
+		parts = append(parts, "weight", fmt.Sprint(*server.Weight))
+	}
+	if server.Verify == models.ServerVerifyNone {
+		parts = append(parts, "verify", "none")
+	}
+	if server.SendProxy == models.ServerSendProxyEnabled {
+		parts = append(parts, "send-proxy")
+	}
+	if server.SendProxyV2 == models.ServerSendProxyV2Enabled {
+		parts = append(parts, "send-proxy-v2")
+	}
+	if options := formatServerParams(serverParams); len(options) > 0 {
+		parts = append(parts, options)
+	}
+	return strings.Join(parts, " ")
+}
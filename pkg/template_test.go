@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func newTestTemplateOutput(t *testing.T, template string) *templateOutput {
+	dir := t.TempDir()
+	config := &data.OutputConfig{File: filepath.Join(dir, "conf.d", "dyna.cfg")}
+	if len(template) > 0 {
+		config.Template = filepath.Join(dir, "dyna.cfg.tmpl")
+		if err := os.WriteFile(config.Template, []byte(template), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output, err := newTemplateOutput(config, filepath.Join(dir, "haproxy.cfg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+func TestTemplateOutputWritesInclude(t *testing.T) {
+	output := newTestTemplateOutput(t, "")
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	clusters := testClusters()
+	clusters[0].Ports[0].HealthCheck = data.HealthCheck{Type: HealthCheckHTTPS}
+
+	result, err := output.apply(buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if !result.ReloadRequired {
+		t.Error("expected the first write to require a reload")
+	}
+	raw, err := os.ReadFile(output.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapFile := filepath.Join(monitorConfig.MapDir, "dyna-frontend-16443.map")
+	for _, expected := range []string{
+		"# " + DefaultOwnershipMarker + "\n",
+		"\nfrontend dyna-frontend-16443\n  mode tcp\n  bind 0.0.0.0:16443 name dyna-frontend-16443\n",
+		"  tcp-request inspect-delay 5000\n",
+		"  use_backend %[req.ssl_sni,lower,map_str(" + exactMapPath(mapFile) + ")] if { req.ssl_sni,lower,map_str(" + exactMapPath(mapFile) + ") -m found }\n",
+		"  use_backend %[req.ssl_sni,lower,map_end(" + mapFile + ")]\n",
+		"\nbackend a.example.com-6443\n  mode tcp\n  option httpchk GET /readyz\n",
+		"  server slot1 192.168.88.2:6443 check verify none check-ssl check-sni api.a.example.com\n",
+		"  server slot3 127.0.0.1:6443 disabled check verify none check-ssl check-sni api.a.example.com\n",
+	} {
+		if !strings.Contains(string(raw), expected) {
+			t.Errorf("expected %q in include:\n%s", expected, raw)
+		}
+	}
+	if _, err := os.Stat(mapFile); err != nil {
+		t.Errorf("expected the map to be written: %s", err)
+	}
+
+	result, err = output.apply(buildModel(clusters, monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) != 0 {
+		t.Errorf("expected no changes, got %v", result.Changes)
+	}
+
+	result, err = output.apply(buildModel(clusters[1:], monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if !result.ReloadRequired {
+		t.Errorf("expected removing a cluster to require a reload, got %v", result.Changes)
+	}
+	if _, err := os.Stat(filepath.Join(monitorConfig.MapDir, "dyna-frontend-10443.map")); !os.IsNotExist(err) {
+		t.Errorf("expected the map of the removed frontend to be deleted, got %v", err)
+	}
+}
+
+func TestTemplateOutputUserTemplate(t *testing.T) {
+	output := newTestTemplateOutput(t, `{{ range .Clusters }}# {{ .BaseDomain }}
+{{ end }}{{ range .Backends }}backend {{ .Name }}
+  {{ join .Servers "\n  " }}
+{{ end }}`)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	monitorConfig.ServerSlots = 1
+
+	_, err := output.apply(buildModel(testClusters()[1:], monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(output.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# b.example.com\nbackend b.example.com-6443\n  slot1 192.168.89.2:6443 check verify none\nbackend dyna-unknown-sni\n  \n"
+	if string(raw) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, raw)
+	}
+
+	if _, err := loadTemplate(filepath.Join(t.TempDir(), "missing.tmpl")); err == nil {
+		t.Error("expected a missing template to fail")
+	}
+	if err := validateOutput(&data.OutputConfig{Type: "nginx"}, &data.MonitorConfig{}); err == nil {
+		t.Error("expected an unknown output type to fail")
+	}
+}
+
+func TestTemplateOutputPlan(t *testing.T) {
+	output := newTestTemplateOutput(t, "")
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+
+	var out bytes.Buffer
+	result, err := output.plan(buildModel(testClusters(), monitorConfig), &out)
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	if len(result.Changes) == 0 {
+		t.Fatal("expected pending changes")
+	}
+	for _, expected := range []string{
+		"--- /dev/null\n+++ " + output.file + "\n",
+		"+backend b.example.com-6443",
+		"+api.b.example.com b.example.com-6443",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in diff:\n%s", expected, out.String())
+		}
+	}
+	if _, err := os.Stat(output.file); !os.IsNotExist(err) {
+		t.Errorf("expected a plan to leave the include unwritten, got %v", err)
+	}
+}
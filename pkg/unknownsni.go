@@ -0,0 +1,244 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haproxytech/models"
+	"github.com/pkg/errors"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	UnknownSNIReject    = "reject"
+	UnknownSNIBackend   = "backend"
+	UnknownSNIResponder = "responder"
+
+	// DefaultResponderAddress is where the unknown SNI responder listens
+	// unless responder-address is set.
+	DefaultResponderAddress = "127.0.0.1:9443"
+
+	unknownSNIBackendName = "dyna-unknown-sni"
+
+	// The unknown SNI table keeps a connection count for each unmatched
+	// SNI, up to the longest host name, for a day after it was last seen.
+	unknownSNITableSize   = 100000
+	unknownSNITableExpire = 24 * 60 * 60 * 1000
+	unknownSNIKeyLength   = 255
+)
+
+func validateUnknownSNIConfig(unknownSNI *data.UnknownSNIConfig) error {
+	switch unknownSNI.Policy {
+	case "", UnknownSNIReject:
+	case UnknownSNIBackend:
+		if len(unknownSNI.Backend) == 0 {
+			return errors.Errorf("unknown-sni policy %s requires backend", unknownSNI.Policy)
+		}
+	case UnknownSNIResponder:
+		if len(unknownSNI.ResponderAddress) > 0 {
+			_, _, err := net.SplitHostPort(unknownSNI.ResponderAddress)
+			if err != nil {
+				return errors.Wrap(err, "invalid unknown-sni responder-address")
+			}
+		}
+	default:
+		return errors.Errorf("unknown unknown-sni policy %s", unknownSNI.Policy)
+	}
+	return nil
+}
+
+func responderAddress(unknownSNI *data.UnknownSNIConfig) string {
+	if len(unknownSNI.ResponderAddress) > 0 {
+		return unknownSNI.ResponderAddress
+	}
+	return DefaultResponderAddress
+}
+
+// unknownSNIDefaultBackend returns the default_backend of every managed
+// frontend, or an empty string if unmatched connections are rejected.
+func unknownSNIDefaultBackend(monitorConfig *data.MonitorConfig) string {
+	switch monitorConfig.UnknownSNI.Policy {
+	case UnknownSNIBackend:
+		return monitorConfig.UnknownSNI.Backend
+	case UnknownSNIResponder:
+		return unknownSNITable(monitorConfig)
+	}
+	return ""
+}
+
+// unknownSNITable returns the backend whose stick table counts the
+// connections seen for each unmatched SNI, whatever the policy.
+func unknownSNITable(monitorConfig *data.MonitorConfig) string {
+	return newOwnership(&monitorConfig.Ownership).name(unknownSNIBackendName)
+}
+
+// unknownSNIRules returns the rules that count each connection matching
+// unmatched in the unknown SNI table, keyed on its SNI. They come before the
+// rules accepting or rejecting the connection, which end the evaluation.
+func unknownSNIRules(table string, unmatched string) models.TCPRequestRules {
+	return models.TCPRequestRules{
+		{
+			Action:   "track-sc0 req.ssl_sni,lower table " + table,
+			Cond:     models.TCPRequestRuleCondIf,
+			CondTest: unmatched,
+			Type:     models.TCPRequestRuleTypeContent,
+		},
+		{
+			Action:   "sc-inc-gpc0(0)",
+			Cond:     models.TCPRequestRuleCondIf,
+			CondTest: unmatched,
+			Type:     models.TCPRequestRuleTypeContent,
+		},
+	}
+}
+
+// buildUnknownSNIBackend renders the backend holding the unknown SNI table.
+// With the responder policy it also hands unmatched connections to the
+// unknown SNI responder.
+func buildUnknownSNIBackend(monitorConfig *data.MonitorConfig) *backendModel {
+	size := int64(unknownSNITableSize)
+	expire := int64(unknownSNITableExpire)
+	keylen := int64(unknownSNIKeyLength)
+	backend := &backendModel{
+		Backend: models.Backend{
+			Mode: models.BackendModeTCP,
+			Name: unknownSNITable(monitorConfig),
+			StickTable: &models.BackendStickTable{
+				Type:   "string",
+				Keylen: &keylen,
+				Size:   &size,
+				Expire: &expire,
+				Store:  "gpc0",
+			},
+		},
+	}
+	if monitorConfig.UnknownSNI.Policy != UnknownSNIResponder {
+		return backend
+	}
+	host, portRaw, _ := net.SplitHostPort(responderAddress(&monitorConfig.UnknownSNI))
+	port, _ := strconv.ParseInt(portRaw, 10, 64)
+	backend.Servers = models.Servers{
+		{
+			Name:    "responder",
+			Address: serverAddress(host),
+			Port:    &port,
+		},
+	}
+	return backend
+}
+
+// unknownSNICounter counts the connections seen for each unmatched SNI.
+type unknownSNICounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newUnknownSNICounter() *unknownSNICounter {
+	return &unknownSNICounter{counts: map[string]int{}}
+}
+
+func (c *unknownSNICounter) count(serverName string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[serverName]
+}
+
+func (c *unknownSNICounter) record(serverName string) int {
+	if len(serverName) == 0 {
+		serverName = "(none)"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[serverName]++
+	count := c.counts[serverName]
+	logrus.Warnf("unknown SNI %s, seen %d times", serverName, count)
+	return count
+}
+
+// selfSignedCertificate returns a throwaway certificate for the responder.
+// Clients reaching it already asked for a cluster that does not exist, so
+// the certificate only needs to complete the handshake.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "haproxy-dyna-configure unknown SNI responder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func newUnknownSNIServer(counter *unknownSNICounter) (*http.Server, error) {
+	certificate, err := selfSignedCertificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create responder certificate")
+	}
+	return &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				counter.record(strings.ToLower(hello.ServerName))
+				return &certificate, nil
+			},
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "cluster not found: no cluster serves %s\n", req.Host)
+		}),
+	}, nil
+}
+
+// ServeUnknownSNI runs the unknown SNI responder until ctx is done. It
+// completes the TLS handshake for any name, logs and counts each unmatched
+// SNI, and answers HTTP requests with a cluster not found page.
+func ServeUnknownSNI(ctx context.Context) error {
+	address := responderAddress(&monitorConfig.MonitorConfig.UnknownSNI)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "unable to listen on %s", address)
+	}
+	return serveUnknownSNI(ctx, listener, newUnknownSNICounter())
+}
+
+func serveUnknownSNI(ctx context.Context, listener net.Listener, counter *unknownSNICounter) error {
+	server, err := newUnknownSNIServer(counter)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logrus.Infof("serving unknown SNI responder on %s", listener.Addr())
+	err = server.ServeTLS(listener, "", "")
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
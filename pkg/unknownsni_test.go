@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/haproxytech/models"
+	"github.com/rvanderp3/haproxy-dyna-configure/data"
+)
+
+func TestValidateUnknownSNIConfig(t *testing.T) {
+	valid := []data.UnknownSNIConfig{
+		{},
+		{Policy: UnknownSNIReject},
+		{Policy: UnknownSNIBackend, Backend: "sink"},
+		{Policy: UnknownSNIResponder},
+		{Policy: UnknownSNIResponder, ResponderAddress: "[::1]:9443"},
+	}
+	for _, unknownSNI := range valid {
+		if err := validateUnknownSNIConfig(&unknownSNI); err != nil {
+			t.Errorf("%+v: %s", unknownSNI, err)
+		}
+	}
+	invalid := []data.UnknownSNIConfig{
+		{Policy: "drop"},
+		{Policy: UnknownSNIBackend},
+		{Policy: UnknownSNIResponder, ResponderAddress: "9443"},
+	}
+	for _, unknownSNI := range invalid {
+		if err := validateUnknownSNIConfig(&unknownSNI); err == nil {
+			t.Errorf("%+v: expected an error", unknownSNI)
+		}
+	}
+}
+
+func TestUnknownSNIResponder(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	counter := newUnknownSNICounter()
+	go serveUnknownSNI(ctx, listener, counter)
+
+	client := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "api.gone.example.com"},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("https://" + listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "cluster not found") {
+			t.Errorf("unexpected response %d %s", resp.StatusCode, body)
+		}
+		client.CloseIdleConnections()
+	}
+	if count := counter.count("api.gone.example.com"); count != 2 {
+		t.Errorf("expected 2 connections counted, got %d", count)
+	}
+}
+
+func TestReconcileKeepsUnknownSNIBackend(t *testing.T) {
+	client, configFile := newTestClient(t)
+	monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+	monitorConfig.UnknownSNI = data.UnknownSNIConfig{Policy: UnknownSNIBackend, Backend: "sink"}
+
+	version, err := client.GetVersion("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.CreateBackend(&models.Backend{Name: "sink", Mode: models.BackendModeTCP}, "", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = reconcile(client, buildModel(testClusters(), monitorConfig))
+	if err != nil {
+		t.Fatalf("failed: %s", err)
+	}
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), "backend sink") || !strings.Contains(string(raw), "default_backend sink") {
+		t.Errorf("expected the sink backend to be kept as default backend:\n%s", raw)
+	}
+	if strings.Contains(string(raw), "tcp-request content reject") {
+		t.Errorf("unmatched SNI should go to the default backend instead of being rejected:\n%s", raw)
+	}
+}
+
+func TestUnknownSNICountedForEveryPolicy(t *testing.T) {
+	for _, unknownSNI := range []data.UnknownSNIConfig{
+		{Policy: UnknownSNIReject},
+		{Policy: UnknownSNIBackend, Backend: "sink"},
+		{Policy: UnknownSNIResponder},
+	} {
+		client, configFile := newTestClient(t)
+		version, err := client.GetVersion("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.CreateBackend(&models.Backend{Name: "sink", Mode: models.BackendModeTCP}, "", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		monitorConfig := testMonitorConfig(t, IpFamilyIPv4)
+		monitorConfig.UnknownSNI = unknownSNI
+
+		_, err = reconcile(client, buildModel(testClusters(), monitorConfig))
+		if err != nil {
+			t.Fatalf("%s: failed: %s", unknownSNI.Policy, err)
+		}
+		raw, err := os.ReadFile(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := string(raw)
+		if !strings.Contains(config, "backend dyna-unknown-sni \n  mode tcp # "+DefaultOwnershipMarker+"\n  stick-table type string len 255 size 100000 expire 86400000 store gpc0\n") {
+			t.Errorf("%s: expected the unknown SNI table:\n%s", unknownSNI.Policy, raw)
+		}
+		track := strings.Index(config, "tcp-request content track-sc0 req.ssl_sni,lower table dyna-unknown-sni if { req_ssl_hello_type 1 } !{ ")
+		count := strings.Index(config, "tcp-request content sc-inc-gpc0(0) if { req_ssl_hello_type 1 } !{ ")
+		accept := strings.Index(config, "tcp-request content accept")
+		if track < 0 || count < track || accept < count {
+			t.Errorf("%s: expected unmatched SNI to be counted before the connection is accepted:\n%s", unknownSNI.Policy, raw)
+		}
+		if reject := strings.Index(config, "tcp-request content reject"); reject >= 0 && reject < count {
+			t.Errorf("%s: expected unmatched SNI to be counted before it is rejected:\n%s", unknownSNI.Policy, raw)
+		}
+
+		result, err := reconcile(client, buildModel(testClusters(), monitorConfig))
+		if err != nil {
+			t.Fatalf("%s: failed: %s", unknownSNI.Policy, err)
+		}
+		if len(result.Changes) != 0 {
+			t.Errorf("%s: expected no changes, got %v", unknownSNI.Policy, result.Changes)
+		}
+	}
+}